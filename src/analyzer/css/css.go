@@ -8,7 +8,7 @@ import (
 	"github.com/nonanick/impatience/analyzer"
 )
 
-var urlImporter, rgErr = regexp.Compile("url\\s*\\((?P<path>.*|.*)\\)\\s*(?:;?)")
+var urlImporter, rgErr = regexp.Compile("url\\s*\\(\\s*(?P<path>[^)]*?)\\s*\\)")
 
 var dependeciesMatcher = []*regexp.Regexp{
 	urlImporter,
@@ -31,6 +31,12 @@ var CSSAnalyzer = func(file string, content []byte) []string {
 	for _, deps := range allDependencies {
 		removeSingleQuotes := strings.ReplaceAll(deps, "'", "")
 		removeDoubleQuotes := strings.ReplaceAll(removeSingleQuotes, "\"", "")
+
+		// data: and external urls are not files of the project
+		if removeDoubleQuotes == "" || strings.HasPrefix(removeDoubleQuotes, "#") ||
+			strings.Contains(removeDoubleQuotes, ":") {
+			continue
+		}
 		strippedDeps = append(strippedDeps, removeDoubleQuotes)
 	}
 
@@ -7,31 +7,28 @@ import (
 
 	"github.com/kr/pretty"
 	"github.com/nonanick/impatience/analyzer"
+	"github.com/nonanick/impatience/transform/jsscan"
 	"github.com/nonanick/impatience/transform/nodemodules"
 )
 
-// ImportRegExp regular expression used to find import statements in js syntax
-var ImportRegExp = regexp.MustCompile(
-	"import\\s*(?P<name>.*)\\s*from.*(?P<path>\".*\"|'.*')(?:;?)",
-)
-
-// ExportRegExp regular expression to find export statements in js syntax
-var ExportRegExp = regexp.MustCompile(
-	"export\\s*(?P<name>.*)\\s*from.*(?P<path>\".*\"|'.*')(?:;?)",
-)
+// dependeciesRegExp extra matchers added with AddMatcher, static imports
+// and exports are found by scanning the code
+var dependeciesRegExp = []*regexp.Regexp{}
 
-var dependeciesRegExp = []*regexp.Regexp{
-	ImportRegExp,
-	ExportRegExp,
-}
-
-// JsAnalyzer - Open and analyzes a JS file searching for its dependencies
+// JsAnalyzer - Open and analyzes a JS file searching for its dependencies,
+// dynamic imports are loaded on demand and are not dependencies
 var JsAnalyzer = func(file string, content []byte) []string {
 
 	allDependencies := make([]string, 0)
 
 	var jsFile []byte = content
 
+	for _, specifier := range jsscan.ModuleSpecifiers(jsscan.Tokenize(jsFile)) {
+		if !specifier.Dynamic {
+			allDependencies = append(allDependencies, specifier.Value)
+		}
+	}
+
 	// Iterate though all RegExp 'macthers'
 	for _, matcher := range dependeciesRegExp {
 		allDependencies = append(allDependencies, analyzer.FindCaptureGroupMatches("path", jsFile, matcher)...)
@@ -44,21 +41,22 @@ var JsAnalyzer = func(file string, content []byte) []string {
 		removeSingleQuotes := strings.ReplaceAll(deps, "'", "")
 		strippedPath := strings.ReplaceAll(removeSingleQuotes, "\"", "")
 
-		// File does not end with '.js' and is a relative "." or absolute path "/"
-		if !strings.HasSuffix(strippedPath, ".js") && (strings.HasPrefix(strippedPath, ".") || strings.HasPrefix(strippedPath, "/")) {
-			strippedDeps = append(strippedDeps, strippedPath)
-		} else
-		// File does not end with '.js' and is NOT a relative or absolute path
-		if !(strings.HasPrefix(removeSingleQuotes, ".") || strings.HasPrefix(strippedPath, "/")) {
+		switch {
+		case nodemodules.IsBareSpecifier(strippedPath):
 			// Probably node module!
-			strippedDeps = append(strippedDeps, strippedPath)
-			pretty.Println(
-				"JS Analyzer found a non relative path that does not contain an .js extension:",
-				strippedPath,
-				"\nIs it a node module?",
-			)
-			nodemodules.AddNodeFile(strippedPath)
-		} else {
+			url, err := nodemodules.AddNodeFile(strippedPath, file)
+			if err != nil {
+				pretty.Println(
+					"JS Analyzer found a non relative path that could not be resolved as a node module:",
+					strippedPath,
+					err.Error(),
+				)
+				continue
+			}
+			strippedDeps = append(strippedDeps, url)
+		case strings.Contains(strippedPath, ":"):
+			// Remote urls are not served by impatience
+		default:
 			strippedDeps = append(strippedDeps, strippedPath)
 		}
 	}
@@ -71,10 +69,19 @@ var javascriptAnalyzer = analyzer.ExtensionAnalyzer{
 	Analyzer: JsAnalyzer,
 }
 
+// Extensions analyzed by the JSAnalyzer, transpiled extensions are analyzed
+// after being transformed to javascript
+var Extensions = []string{".js", ".mjs", ".cjs", ".jsx", ".ts", ".tsx"}
+
 // Register - Register in the Analyzer the JSAnalyzer function
 func Register() {
 	mime.AddExtensionType(".js", "text/javascript")
-	analyzer.ForExtension(".js", javascriptAnalyzer)
+	mime.AddExtensionType(".mjs", "text/javascript")
+	mime.AddExtensionType(".cjs", "text/javascript")
+
+	for _, extension := range Extensions {
+		analyzer.ForExtension(extension, javascriptAnalyzer)
+	}
 }
 
 // AddMatcher Add a RegExp that will match the path for the dependency inside of the file
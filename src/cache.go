@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/kr/pretty"
+	"github.com/nonanick/impatience/transform/diskcache"
+)
+
+// Cache manages the transform cache, "clean" removes every cached output
+func Cache(args []string) {
+	declareOptions()
+	args = parseFlags("cache", args)
+
+	if len(args) == 0 {
+		size, entries := diskcache.Size()
+		fmt.Printf(
+			"[Impatience - Cache]:\n	Folder: %s\n	Entries: %d\n	Size: %d bytes\n",
+			diskcache.Dir(), entries, size,
+		)
+		return
+	}
+
+	switch args[0] {
+	case "clean":
+		if err := diskcache.Clean(); err != nil {
+			pretty.Println("[Impatience - Cache] Could not clean", diskcache.Dir(), err.Error())
+			return
+		}
+		pretty.Println("[Impatience - Cache] Removed", diskcache.Dir())
+	default:
+		pretty.Println("[Impatience - Cache] Unknown cache command:", args[0], "use \"clean\"")
+	}
+}
@@ -1,7 +1,7 @@
 package cache
 
 import (
-	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
 	"net/http"
 )
@@ -60,14 +60,13 @@ type Strategy struct {
 	Insert  InsertStrategyFn
 }
 
-// CalculateHash calculate the hash for a single file
-func CalculateHash(path string, lastModified string) string {
-	hash := md5.New()
-	bytes := []byte(HashSalt + path + lastModified)
-	hash.Write(bytes)
-	encodedHash := base64.StdEncoding.EncodeToString(hash.Sum(nil))
+// ContentHash opaque tag of the bytes served for a file, files with the
+// same content share the same tag whatever their path or mtime
+func ContentHash(content []byte) string {
+	hash := sha256.Sum256(content)
 
-	return encodedHash
+	// Url safe and without padding, so the tag also fits in cookies
+	return base64.RawURLEncoding.EncodeToString(hash[:])
 }
 
 // Extract strategy currently being used
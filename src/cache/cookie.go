@@ -1,21 +1,29 @@
 package cache
 
 import (
+	"encoding/base64"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/nonanick/impatience/options"
 )
 
 const (
-	// HashSalt Adds a static salt to hashed files
-	HashSalt = "ImpatienceSvCookie"
-	// CookieCachedFilesName name of the coockie holding the cache
+	// CookieCachedFilesName name of the coockie holding the cache, the
+	// following parts of the cache are named after it with their index
 	CookieCachedFilesName = "ImpatienceCacheControl"
-	// CookieFileSeparator string that shall seoarate file names
-	CookieFileSeparator = "_&_"
+	// CookiePartSeparator separates the amount of parts from the cache in the
+	// first cookie
+	CookiePartSeparator = "."
+	// CookieMaxValueSize bytes of the cache held by each cookie, browsers
+	// drop cookies over ~4KB
+	CookieMaxValueSize = 3800
 )
 
-// CookieStrategy file cache strategy
+// CookieStrategy file cache strategy, the etags of the files the client
+// cached are kept as a golomb coded set in one or more cookies
 var CookieStrategy = Strategy{
 	// Extract strategy
 	Extract: func(
@@ -23,24 +31,16 @@ var CookieStrategy = Strategy{
 		knownFileHashes map[string]string,
 	) map[string]bool {
 
-		// Check if cookie exists, otherwise return empty string array
-		cookie, err := request.Cookie(CookieCachedFilesName)
-		if err != nil {
+		cachedSet, ok := readCookieSet(request)
+		if !ok {
 			return map[string]bool{}
 		}
 
-		fileHashs := strings.Split(cookie.Value, CookieFileSeparator)
 		knownCaches := map[string]bool{}
-		knownHashes := make(map[string]bool)
-
-		// Create map of known hashs for easy access
-		for _, knownHash := range knownFileHashes {
-			knownHashes[knownHash] = true
-		}
 
-		// Check each cache hash and confirm if it exists in current known files (file change => invalidate cache!)
-		for _, hash := range fileHashs {
-			if knownHashes[hash] {
+		// Only known hashes are checked (file change => invalidate cache!)
+		for _, hash := range knownFileHashes {
+			if hash != "" && cachedSet.Contains(hash) {
 				knownCaches[hash] = true
 			}
 		}
@@ -53,23 +53,126 @@ var CookieStrategy = Strategy{
 		previouslyCached map[string]bool,
 		pushedFiles []string,
 	) {
+		// Newly pushed files first, they are the last to be dropped when the
+		// cache does not fit in the budget
 		allHashs := []string{}
+		included := map[string]bool{}
+
+		for _, hash := range pushedFiles {
+			if !included[hash] {
+				allHashs = append(allHashs, hash)
+				included[hash] = true
+			}
+		}
 
 		for hash := range previouslyCached {
-			allHashs = append(allHashs, hash)
+			if !included[hash] {
+				allHashs = append(allHashs, hash)
+				included[hash] = true
+			}
 		}
 
-		allHashs = append(allHashs, pushedFiles...)
+		encoded := encodeWithinBudget(allHashs, options.CacheCookieBudget)
 
-		cookie := http.Cookie{
-			HttpOnly: true,
-			Name:     CookieCachedFilesName,
-			Value:    strings.Join(allHashs, CookieFileSeparator),
-			Path:     "/",
-			Secure:   true,
-			Expires:  time.Now().Add(2 * 24 * time.Hour),
+		parts := []string{}
+		for len(encoded) > CookieMaxValueSize {
+			parts = append(parts, encoded[:CookieMaxValueSize])
+			encoded = encoded[CookieMaxValueSize:]
 		}
+		parts = append(parts, encoded)
 
-		http.SetCookie(response, &cookie)
+		for index, part := range parts {
+			name := CookieCachedFilesName
+			if index == 0 {
+				part = strconv.Itoa(len(parts)) + CookiePartSeparator + part
+			} else {
+				name += strconv.Itoa(index)
+			}
+
+			cookie := http.Cookie{
+				HttpOnly: true,
+				Name:     name,
+				Value:    part,
+				Path:     "/",
+				Secure:   true,
+				Expires:  time.Now().Add(2 * 24 * time.Hour),
+			}
+
+			http.SetCookie(response, &cookie)
+		}
+
+		// Parts left from a bigger cache would be sent with every request
+		for index := len(parts); index <= options.CacheCookieBudget/CookieMaxValueSize; index++ {
+			http.SetCookie(response, &http.Cookie{
+				HttpOnly: true,
+				Name:     CookieCachedFilesName + strconv.Itoa(index),
+				Path:     "/",
+				Secure:   true,
+				MaxAge:   -1,
+			})
+		}
 	},
 }
+
+// readCookieSet joins the cookie parts of the cache and decodes the set
+func readCookieSet(request *http.Request) (*GolombSet, bool) {
+	first, err := request.Cookie(CookieCachedFilesName)
+	if err != nil {
+		return nil, false
+	}
+
+	separator := strings.Index(first.Value, CookiePartSeparator)
+	if separator < 0 {
+		return nil, false
+	}
+
+	count, err := strconv.Atoi(first.Value[:separator])
+	if err != nil || count < 1 {
+		return nil, false
+	}
+
+	encoded := first.Value[separator+1:]
+	for index := 1; index < count; index++ {
+		part, err := request.Cookie(CookieCachedFilesName + strconv.Itoa(index))
+		if err != nil {
+			return nil, false
+		}
+		encoded += part.Value
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, false
+	}
+
+	cachedSet, err := DecodeGolombSet(decoded)
+	if err != nil {
+		return nil, false
+	}
+
+	return cachedSet, true
+}
+
+// encodeWithinBudget encodes the set of the first hashes fitting in budget
+// bytes, once encoded as base64
+func encodeWithinBudget(hashes []string, budget int) string {
+	probabilityBits := ProbabilityBitsOf(options.CacheFalsePositiveRate)
+	count := len(hashes)
+
+	for {
+		encoded := base64.RawURLEncoding.EncodeToString(
+			NewGolombSet(hashes[:count], probabilityBits).Encode(),
+		)
+
+		if budget <= 0 || len(encoded) <= budget || count == 0 {
+			return encoded
+		}
+
+		// Shrink in proportion to the excess, at least by one hash
+		fitting := count * budget / len(encoded)
+		if fitting >= count {
+			fitting = count - 1
+		}
+		count = fitting
+	}
+}
@@ -0,0 +1,53 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/nonanick/impatience/options"
+)
+
+func TestCookieInsertExpiresUnusedParts(t *testing.T) {
+	budget := options.CacheCookieBudget
+	options.CacheCookieBudget = 3 * CookieMaxValueSize
+	defer func() { options.CacheCookieBudget = budget }()
+
+	cases := []struct {
+		name   string
+		hashes []string
+		// parts cookies holding the cache, the others are expired
+		parts int
+	}{
+		{"one part", keysOf("one", 10), 1},
+		{"several parts", keysOf("several", 3000), 2},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			CookieStrategy.Insert(recorder, map[string]bool{}, test.hashes)
+
+			cookies := map[string]*http.Cookie{}
+			for _, cookie := range (&http.Response{Header: recorder.Header()}).Cookies() {
+				cookies[cookie.Name] = cookie
+			}
+
+			for index := 0; index <= 3; index++ {
+				name := CookieCachedFilesName
+				if index > 0 {
+					name += strconv.Itoa(index)
+				}
+
+				cookie, set := cookies[name]
+				if !set {
+					t.Fatalf("%s not set", name)
+				}
+				if expired := cookie.MaxAge < 0; expired != (index >= test.parts) {
+					t.Errorf("%s: expired %t, holding %d parts", name, expired, test.parts)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+const (
+	// DigestHeader request header holding the cache digests of the client
+	DigestHeader = "Cache-Digest"
+	// DigestWorkerURL url of the service worker sending the cache digests,
+	// served from the root so its scope covers every page
+	DigestWorkerURL = "/_impatience-cache-digest.js"
+)
+
+// Strategies cache strategies selectable by name
+var Strategies = map[string]Strategy{
+	"cookie": CookieStrategy,
+	"digest": DigestStrategy,
+}
+
+// cacheDigest digest of the Cache-Digest header with its flags
+type cacheDigest struct {
+	set        *GolombSet
+	validators bool
+}
+
+// DigestStrategy file cache strategy reading the Cache-Digest header (the
+// golomb coded set format of the HTTP cache digest draft) sent by the
+// service worker at DigestWorkerURL. Only digests with validators are used,
+// their keys are the url followed by the etag of the cached response
+var DigestStrategy = Strategy{
+	// Extract strategy
+	Extract: func(
+		request *http.Request,
+		knownFileHashes map[string]string,
+	) map[string]bool {
+
+		knownCaches := map[string]bool{}
+
+		digests := parseDigests(request.Header.Values(DigestHeader))
+		if len(digests) == 0 {
+			return knownCaches
+		}
+
+		origin := "https://" + request.Host
+		for publicPath, hash := range knownFileHashes {
+			if hash == "" {
+				continue
+			}
+
+			url := origin + publicPath
+			for _, digest := range digests {
+				if !digest.validators {
+					continue
+				}
+
+				// The worker sends the etag as found in the ETag header
+				if digest.set.Contains(url+`"`+hash+`"`) ||
+					digest.set.Contains(url+`W/"`+hash+`"`) {
+					knownCaches[hash] = true
+					break
+				}
+			}
+		}
+
+		return knownCaches
+	},
+	// Insert strategy, the worker keeps track of the cached responses
+	Insert: func(
+		response http.ResponseWriter,
+		previouslyCached map[string]bool,
+		pushedFiles []string,
+	) {
+	},
+}
+
+// parseDigests parses the values of Cache-Digest headers, invalid digests
+// are skipped
+func parseDigests(values []string) []cacheDigest {
+	digests := []cacheDigest{}
+
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			parameters := strings.Split(entry, ";")
+
+			encoded := strings.TrimRight(strings.TrimSpace(parameters[0]), "=")
+			decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+			if err != nil {
+				continue
+			}
+
+			set, err := DecodeGolombSet(decoded)
+			if err != nil {
+				continue
+			}
+
+			// The reset, complete and stale flags do not change which files
+			// are skipped
+			digest := cacheDigest{set: set}
+			for _, flag := range parameters[1:] {
+				if strings.ToLower(strings.TrimSpace(flag)) == "validators" {
+					digest.validators = true
+				}
+			}
+
+			digests = append(digests, digest)
+		}
+	}
+
+	return digests
+}
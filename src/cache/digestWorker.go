@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/nonanick/impatience/options"
+)
+
+// DigestWorker script of the service worker served at DigestWorkerURL, it
+// remembers the etag of each response and sends a digest of them with every
+// request. Pages register it with:
+//
+//	navigator.serviceWorker.register("/_impatience-cache-digest.js")
+func DigestWorker() []byte {
+	probabilityBits := ProbabilityBitsOf(options.CacheFalsePositiveRate)
+
+	return []byte(strings.Replace(
+		digestWorkerScript,
+		"{{probabilityBits}}",
+		strconv.Itoa(int(probabilityBits)),
+		1,
+	))
+}
+
+const digestWorkerScript = `// Impatience cache digest helper: remembers the etag of every response and
+// announces them in a Cache-Digest header, so pushes are skipped for the
+// responses the browser already has
+const PROBABILITY_BITS = {{probabilityBits}};
+const CACHE_NAME = "impatience-cache-digest";
+
+let digest = null;
+
+self.addEventListener("install", () => self.skipWaiting());
+self.addEventListener("activate", (event) => event.waitUntil(self.clients.claim()));
+
+self.addEventListener("fetch", (event) => {
+  const request = event.request;
+  if (request.method !== "GET" || new URL(request.url).origin !== self.location.origin) {
+    return;
+  }
+
+  event.respondWith(fetchWithDigest(request));
+});
+
+async function fetchWithDigest(request) {
+  const headers = new Headers(request.headers);
+  headers.set("Cache-Digest", (await currentDigest()) + "; complete; validators");
+
+  const response = await fetch(request.url, {
+    headers,
+    credentials: request.credentials,
+    redirect: request.mode === "navigate" ? "manual" : request.redirect,
+  });
+
+  const etag = response.headers.get("ETag");
+  if (response.ok && etag) {
+    await remember(request.url, etag);
+  } else if (response.status === 404) {
+    await forget(request.url);
+  }
+
+  return response;
+}
+
+// Only the etag is kept, the browser cache holds the responses
+async function remember(url, etag) {
+  const cache = await caches.open(CACHE_NAME);
+  const cached = await cache.match(url);
+  if (cached && cached.headers.get("ETag") === etag) {
+    return;
+  }
+
+  await cache.put(url, new Response(null, { headers: { ETag: etag } }));
+  digest = null;
+}
+
+async function forget(url) {
+  const cache = await caches.open(CACHE_NAME);
+  if (await cache.delete(url)) {
+    digest = null;
+  }
+}
+
+function currentDigest() {
+  if (digest === null) {
+    digest = computeDigest();
+  }
+  return digest;
+}
+
+// computeDigest golomb coded set of the url + etag of the remembered
+// responses, base64url encoded
+async function computeDigest() {
+  const cache = await caches.open(CACHE_NAME);
+  const keys = [];
+  for (const request of await cache.keys()) {
+    const response = await cache.match(request);
+    const etag = response && response.headers.get("ETag");
+    if (etag) {
+      keys.push(request.url + etag);
+    }
+  }
+
+  let countBits = 0;
+  while (2 ** countBits < keys.length) {
+    countBits++;
+  }
+  const bits = countBits + PROBABILITY_BITS;
+
+  const values = [];
+  for (const key of keys) {
+    const hash = new Uint8Array(await crypto.subtle.digest("SHA-256", new TextEncoder().encode(key)));
+    let value = 0;
+    for (let bit = 0; bit < bits; bit++) {
+      value = value * 2 + ((hash[bit >> 3] >> (7 - (bit & 7))) & 1);
+    }
+    values.push(value);
+  }
+  values.sort((a, b) => a - b);
+
+  const writer = bitWriter();
+  writer.write(countBits, 5);
+  writer.write(PROBABILITY_BITS, 5);
+
+  const divisor = 2 ** PROBABILITY_BITS;
+  let previous = -1;
+  for (const value of values) {
+    if (value === previous) {
+      continue;
+    }
+
+    const delta = value - previous - 1;
+    for (let quotient = Math.floor(delta / divisor); quotient > 0; quotient--) {
+      writer.write(0, 1);
+    }
+    writer.write(1, 1);
+    writer.write(delta % divisor, PROBABILITY_BITS);
+    previous = value;
+  }
+
+  let binary = "";
+  for (const byte of writer.bytes) {
+    binary += String.fromCharCode(byte);
+  }
+  return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+function bitWriter() {
+  const bytes = [];
+  let used = 0;
+
+  return {
+    bytes,
+    write(value, bits) {
+      for (let bit = bits - 1; bit >= 0; bit--) {
+        if (used % 8 === 0) {
+          bytes.push(0);
+        }
+        if (Math.floor(value / 2 ** bit) % 2 === 1) {
+          bytes[bytes.length - 1] |= 0x80 >> (used % 8);
+        }
+        used++;
+      }
+    },
+  };
+}
+`
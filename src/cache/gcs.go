@@ -0,0 +1,189 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+var errInvalidGolombSet = errors.New("Invalid golomb coded set")
+
+// GolombSet set of keys encoded as a Golomb coded set, in the format of the
+// Cache-Digest draft. Contains answers true for a key outside of the set
+// with a probability of 1/2^ProbabilityBits
+type GolombSet struct {
+	// CountBits log2 of the amount of keys, rounded up to a power of 2
+	CountBits uint
+	// ProbabilityBits log2 of the inverse of the false positive rate
+	ProbabilityBits uint
+
+	// values sorted hashes of the keys
+	values []uint64
+}
+
+// NewGolombSet set holding the keys
+func NewGolombSet(keys []string, probabilityBits uint) *GolombSet {
+	countBits := uint(0)
+	for 1<<countBits < len(keys) {
+		countBits++
+	}
+
+	set := &GolombSet{CountBits: countBits, ProbabilityBits: probabilityBits}
+	for _, key := range keys {
+		set.values = append(set.values, set.hash(key))
+	}
+	sort.Slice(set.values, func(a, b int) bool {
+		return set.values[a] < set.values[b]
+	})
+
+	return set
+}
+
+// ProbabilityBitsOf probability bits giving at most the false positive rate
+func ProbabilityBitsOf(rate float64) uint {
+	if rate <= 0 || rate >= 1 {
+		return 8
+	}
+
+	bits := uint(math.Ceil(math.Log2(1 / rate)))
+	if bits < 1 {
+		return 1
+	}
+	if bits > 31 {
+		return 31
+	}
+	return bits
+}
+
+// Contains the key is in the set, or is a false positive
+func (set *GolombSet) Contains(key string) bool {
+	value := set.hash(key)
+	index := sort.Search(len(set.values), func(index int) bool {
+		return set.values[index] >= value
+	})
+
+	return index < len(set.values) && set.values[index] == value
+}
+
+// Len amount of distinct values in the set
+func (set *GolombSet) Len() int {
+	count := 0
+	for index, value := range set.values {
+		if index == 0 || value != set.values[index-1] {
+			count++
+		}
+	}
+	return count
+}
+
+// Encode the set: 5 bits of CountBits, 5 bits of ProbabilityBits then the
+// difference between consecutive values, Golomb-Rice coded
+func (set *GolombSet) Encode() []byte {
+	writer := &bitWriter{}
+	writer.write(uint64(set.CountBits), 5)
+	writer.write(uint64(set.ProbabilityBits), 5)
+
+	previous := int64(-1)
+	for _, value := range set.values {
+		if int64(value) == previous {
+			continue
+		}
+
+		delta := uint64(int64(value) - previous - 1)
+		for quotient := delta >> set.ProbabilityBits; quotient > 0; quotient-- {
+			writer.write(0, 1)
+		}
+		writer.write(1, 1)
+		writer.write(delta, set.ProbabilityBits)
+
+		previous = int64(value)
+	}
+
+	return writer.bytes
+}
+
+// DecodeGolombSet decodes a set encoded by Encode, the trailing padding
+// bits are ignored
+func DecodeGolombSet(encoded []byte) (*GolombSet, error) {
+	reader := &bitReader{bytes: encoded}
+
+	countBits, countOk := reader.read(5)
+	probabilityBits, probabilityOk := reader.read(5)
+	if !countOk || !probabilityOk {
+		return nil, errInvalidGolombSet
+	}
+
+	set := &GolombSet{CountBits: uint(countBits), ProbabilityBits: uint(probabilityBits)}
+	if set.CountBits+set.ProbabilityBits > 62 {
+		return nil, errInvalidGolombSet
+	}
+
+	previous := int64(-1)
+	for {
+		quotient := uint64(0)
+		bit, ok := reader.read(1)
+		for ok && bit == 0 {
+			quotient++
+			bit, ok = reader.read(1)
+		}
+		if !ok {
+			break
+		}
+
+		remainder, ok := reader.read(set.ProbabilityBits)
+		if !ok {
+			break
+		}
+
+		value := previous + 1 + int64(quotient<<set.ProbabilityBits|remainder)
+		set.values = append(set.values, uint64(value))
+		previous = value
+	}
+
+	return set, nil
+}
+
+// hash of a key, truncated to CountBits + ProbabilityBits bits
+func (set *GolombSet) hash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8]) >> (64 - set.CountBits - set.ProbabilityBits)
+}
+
+// bitWriter appends bits to bytes, most significant bit first
+type bitWriter struct {
+	bytes []byte
+	used  uint
+}
+
+func (writer *bitWriter) write(value uint64, bits uint) {
+	for bit := bits; bit > 0; bit-- {
+		if writer.used%8 == 0 {
+			writer.bytes = append(writer.bytes, 0)
+		}
+		if value>>(bit-1)&1 == 1 {
+			writer.bytes[len(writer.bytes)-1] |= 0x80 >> (writer.used % 8)
+		}
+		writer.used++
+	}
+}
+
+// bitReader reads bits from bytes, most significant bit first
+type bitReader struct {
+	bytes    []byte
+	position uint
+}
+
+func (reader *bitReader) read(bits uint) (uint64, bool) {
+	value := uint64(0)
+	for ; bits > 0; bits-- {
+		if reader.position >= uint(len(reader.bytes))*8 {
+			return 0, false
+		}
+		bit := reader.bytes[reader.position/8] >> (7 - reader.position%8) & 1
+		value = value<<1 | uint64(bit)
+		reader.position++
+	}
+	return value, true
+}
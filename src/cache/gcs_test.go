@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"encoding/base64"
+	"strconv"
+	"testing"
+
+	"github.com/nonanick/impatience/options"
+)
+
+func keysOf(prefix string, count int) []string {
+	keys := []string{}
+	for index := 0; index < count; index++ {
+		keys = append(keys, ContentHash([]byte(prefix+strconv.Itoa(index))))
+	}
+	return keys
+}
+
+func TestGolombSetRoundTrip(t *testing.T) {
+	cases := []struct {
+		name            string
+		keys            []string
+		probabilityBits uint
+	}{
+		{"empty", []string{}, 7},
+		{"single", keysOf("single", 1), 7},
+		{"hundreds", keysOf("hundreds", 500), 7},
+		{"default rate", keysOf("default", 300), ProbabilityBitsOf(0.01)},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			set, err := DecodeGolombSet(NewGolombSet(test.keys, test.probabilityBits).Encode())
+			if err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+
+			if set.ProbabilityBits != test.probabilityBits {
+				t.Errorf("probability bits: got %d, want %d", set.ProbabilityBits, test.probabilityBits)
+			}
+			if set.Len() > len(test.keys) || len(test.keys)-set.Len() > len(test.keys)/50 {
+				t.Errorf("len: got %d for %d keys", set.Len(), len(test.keys))
+			}
+
+			for _, key := range test.keys {
+				if !set.Contains(key) {
+					t.Errorf("missing key %s", key)
+				}
+			}
+
+			// Twice the expected false positive rate leaves room for chance
+			outside := keysOf("outside-"+test.name, 10000)
+			falsePositives := 0
+			for _, key := range outside {
+				if set.Contains(key) {
+					falsePositives++
+				}
+			}
+			if allowed := 2 * len(outside) >> test.probabilityBits; falsePositives > allowed {
+				t.Errorf("false positives: got %d, allowed %d", falsePositives, allowed)
+			}
+		})
+	}
+}
+
+func TestGolombSetEncoding(t *testing.T) {
+	// Encoded by the digest worker script
+	keys := []string{`/index.js"a"`, `/app.css"b"`, `/logo.svg"c"`}
+	expected := "Efwdd2A"
+
+	encoded := base64.RawURLEncoding.EncodeToString(NewGolombSet(keys, 7).Encode())
+	if encoded != expected {
+		t.Errorf("got %s, want %s", encoded, expected)
+	}
+}
+
+func TestDecodeInvalidGolombSet(t *testing.T) {
+	cases := []struct {
+		name    string
+		encoded []byte
+	}{
+		{"no header", []byte{}},
+		{"truncated header", []byte{0xff}},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := DecodeGolombSet(test.encoded); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestEncodeWithinBudget(t *testing.T) {
+	hashes := keysOf("budget", 2000)
+	// Hashes of distinct keys may collide in the set
+	all := NewGolombSet(hashes, ProbabilityBitsOf(options.CacheFalsePositiveRate)).Len()
+
+	cases := []struct {
+		name   string
+		budget int
+		// trimmed some hashes are expected to be left out
+		trimmed bool
+	}{
+		{"unlimited", 0, false},
+		{"large", 100000, false},
+		{"medium", 1000, true},
+		{"small", 10, true},
+		{"empty set", 3, true},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			encoded := encodeWithinBudget(hashes, test.budget)
+			if test.budget > 0 && len(encoded) > test.budget {
+				t.Fatalf("length %d over the budget %d", len(encoded), test.budget)
+			}
+
+			decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+			if err != nil {
+				t.Fatalf("base64: %s", err)
+			}
+			set, err := DecodeGolombSet(decoded)
+			if err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+
+			if test.trimmed != (set.Len() < all) {
+				t.Errorf("kept %d of %d hashes", set.Len(), all)
+			}
+
+			// The first hashes are the ones kept
+			if set.Len() > 0 && !set.Contains(hashes[0]) {
+				t.Error("first hash dropped")
+			}
+		})
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
 
 	"github.com/nonanick/impatience/files"
 )
@@ -14,6 +16,13 @@ var IgnoredDirectories = []string{
 	"node_modules",
 }
 
+// MaxConcurrentFiles how many files may be transformed/analyzed at the same
+// time, transformers backed by workers handle them concurrently
+var MaxConcurrentFiles = runtime.NumCPU() * 2
+
+// processing limits the files being added at the same time
+var processing = make(chan bool, MaxConcurrentFiles)
+
 // Crawl will search for all the files and directories inside the root
 func Crawl(root string) DirectoryGraph {
 
@@ -59,8 +68,11 @@ func crawlDirectory(
 	}
 
 	childLength := len(allDirChildren)
+	addedFiles := make([]*files.File, childLength)
+
+	var wait sync.WaitGroup
 
-	for _, fileOrDir := range allDirChildren {
+	for index, fileOrDir := range allDirChildren {
 
 		if fileOrDir.IsDir() {
 
@@ -80,13 +92,30 @@ func crawlDirectory(
 		} else {
 
 			filePath := filepath.Join(dirPath, fileOrDir.Name())
-			fileInfo, addErr := files.Add(filePath)
 
-			if addErr != nil {
-				fmt.Println("Failed to add file ", filePath, ", returned error: ", addErr)
-			} else {
-				innerFiles = append(innerFiles, fileInfo)
-			}
+			wait.Add(1)
+			processing <- true
+
+			go func(index int, filePath string) {
+				defer wait.Done()
+				defer func() { <-processing }()
+
+				fileInfo, addErr := files.Add(filePath)
+
+				if addErr != nil {
+					fmt.Println("Failed to add file ", filePath, ", returned error: ", addErr)
+				} else {
+					addedFiles[index] = fileInfo
+				}
+			}(index, filePath)
+		}
+	}
+
+	wait.Wait()
+
+	for _, fileInfo := range addedFiles {
+		if fileInfo != nil {
+			innerFiles = append(innerFiles, fileInfo)
 		}
 	}
 
@@ -0,0 +1,98 @@
+// Package diagnostics collects the problems found while analyzing or
+// transforming files, a failing analyzer/transformer should report what
+// happened here instead of aborting the server
+package diagnostics
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Severity how serious a reported diagnostic is
+type Severity string
+
+const (
+	// Error something failed and the output may be incomplete
+	Error Severity = "ERROR"
+	// Warning something looks wrong but the output is still usable
+	Warning Severity = "WARN"
+)
+
+// Diagnostic a single problem reported for a file
+type Diagnostic struct {
+	Source   string
+	Path     string
+	Severity Severity
+	Message  string
+}
+
+var lock sync.Mutex
+
+// reported hold all diagnostics indexed by the file path
+var reported = map[string][]Diagnostic{}
+
+// Report stores and prints a diagnostic
+func Report(diagnostic Diagnostic) {
+	if diagnostic.Severity == "" {
+		diagnostic.Severity = Error
+	}
+
+	lock.Lock()
+	reported[diagnostic.Path] = append(reported[diagnostic.Path], diagnostic)
+	lock.Unlock()
+
+	fmt.Println(diagnostic.String())
+}
+
+// Errorf reports an error diagnostic for a file
+func Errorf(source string, path string, format string, args ...interface{}) {
+	Report(Diagnostic{
+		Source:   source,
+		Path:     path,
+		Severity: Error,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Warnf reports a warning diagnostic for a file
+func Warnf(source string, path string, format string, args ...interface{}) {
+	Report(Diagnostic{
+		Source:   source,
+		Path:     path,
+		Severity: Warning,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// For return all diagnostics reported for a file
+func For(path string) []Diagnostic {
+	lock.Lock()
+	defer lock.Unlock()
+
+	return append([]Diagnostic{}, reported[path]...)
+}
+
+// Clear forget all diagnostics of a file, should be called before the file
+// is processed again
+func Clear(path string) {
+	lock.Lock()
+	delete(reported, path)
+	lock.Unlock()
+}
+
+// All return every diagnostic currently reported
+func All() []Diagnostic {
+	lock.Lock()
+	defer lock.Unlock()
+
+	all := []Diagnostic{}
+	for _, diagnostics := range reported {
+		all = append(all, diagnostics...)
+	}
+
+	return all
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: [%s] %s: %s", d.Severity, d.Source, d.Path, d.Message)
+}
@@ -0,0 +1,48 @@
+package external
+
+import (
+	"strings"
+
+	"github.com/nonanick/impatience/analyzer"
+	"github.com/nonanick/impatience/diagnostics"
+	"github.com/nonanick/impatience/options"
+)
+
+// RegisterAnalyzers adds an analyzer for each extension configured in
+// options.ExternalAnalyzers
+func RegisterAnalyzers() {
+	for extension, command := range options.ExternalAnalyzers {
+		analyzer.ForExtension(extension, analyzer.ExtensionAnalyzer{
+			Name:     "External Analyzer (" + command + ")",
+			Analyzer: CommandAnalyzer(command),
+		})
+	}
+}
+
+// CommandAnalyzer creates an analyzer that runs the command, each non empty
+// line printed by the command is a dependency of the analyzed file
+func CommandAnalyzer(command string) analyzer.ExtensionAnalyzerFunc {
+	return func(path string, content []byte) []string {
+		result, err := Run(command, path, content)
+		if err != nil {
+			diagnostics.Errorf("External Analyzer", path, "%s: %s", command, describe(err, result))
+			return []string{}
+		}
+
+		return ParseDependencies(result.Stdout)
+	}
+}
+
+// ParseDependencies split the analyzer output into dependencies, one per line
+func ParseDependencies(output []byte) []string {
+	dependencies := []string{}
+
+	for _, line := range strings.Split(string(output), "\n") {
+		dependency := strings.TrimSpace(line)
+		if dependency != "" {
+			dependencies = append(dependencies, dependency)
+		}
+	}
+
+	return dependencies
+}
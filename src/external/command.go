@@ -0,0 +1,106 @@
+// Package external bridges Impatience with analyzers and transformers that
+// live outside Go, they are plain commands configured by extension
+package external
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/nonanick/impatience/options"
+)
+
+// Result output of an external command
+type Result struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+}
+
+// Run executes the command passing the file path as its last argument and
+// the file content on stdin, the command is killed once the configured
+// timeout is reached
+func Run(command string, path string, content []byte) (Result, error) {
+	return RunContext(context.Background(), command, path, content)
+}
+
+// RunContext same as Run but the command can also be cancelled using ctx
+func RunContext(
+	ctx context.Context,
+	command string,
+	path string,
+	content []byte,
+) (Result, error) {
+
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return Result{}, errors.New("empty external command")
+	}
+
+	if options.ExternalCommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.ExternalCommandTimeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], path)...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if startErr := cmd.Start(); startErr != nil {
+		return Result{}, startErr
+	}
+
+	// Processes spawned by the command may keep its output open after it
+	// was killed, so the wait can't hold the caller past the context
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var runErr error
+	select {
+	case runErr = <-done:
+	case <-ctx.Done():
+	}
+
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return Result{}, errors.New("command timed out after " + options.ExternalCommandTimeout.String())
+	case context.Canceled:
+		return Result{}, errors.New("command was cancelled")
+	}
+
+	result := Result{
+		Stdout: stdout.Bytes(),
+		Stderr: stderr.Bytes(),
+	}
+
+	if runErr != nil {
+		var exitErr *exec.ExitError
+		if errors.As(runErr, &exitErr) {
+			result.ExitCode = exitErr.ExitCode()
+			return result, fmt.Errorf("command exited with code %d", result.ExitCode)
+		}
+
+		return result, runErr
+	}
+
+	return result, nil
+}
+
+// describe format the stderr output to be used in a diagnostic message
+func describe(err error, result Result) string {
+	stderr := strings.TrimSpace(string(result.Stderr))
+	if stderr == "" {
+		return err.Error()
+	}
+
+	return err.Error() + "\n" + stderr
+}
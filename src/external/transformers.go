@@ -0,0 +1,150 @@
+package external
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/nonanick/impatience/diagnostics"
+	"github.com/nonanick/impatience/options"
+	"github.com/nonanick/impatience/transform"
+	"github.com/nonanick/impatience/transform/worker"
+)
+
+// TransformerName name of the external transformers in pipelines, each
+// extension has its own
+const TransformerName = "external"
+
+// RegisterTransformers adds a transformer for each extension configured in
+// options.ExternalTransformers
+func RegisterTransformers() {
+	for extension, transformer := range options.ExternalTransformers {
+		if transformer.MimeType != "" || transformer.Extension != "" {
+			transform.DeclareOutput(extension, transformer.Extension, transformer.MimeType)
+		}
+
+		run := CommandTransformer(transformer.Command)
+		if transformer.Worker {
+			run = WorkerTransformer(transformer.Command)
+		}
+
+		// The command identifies the output, changing the command or
+		// cleaning the cache transforms the files again
+		version := transformer.Command
+		if transformer.NoCache {
+			version = ""
+		}
+
+		transform.AddTransformer(transform.Transformer{
+			Name:       TransformerName,
+			Extensions: []string{extension},
+			Priority:   transform.DefaultPriority,
+			Checked:    run,
+			Version:    version,
+		})
+	}
+}
+
+// running hold the cancel function of the commands still transforming a file
+var running = map[string]*run{}
+var runningLock sync.Mutex
+
+type run struct {
+	cancel context.CancelFunc
+}
+
+// CommandTransformer creates a transformer that pipes the file content through
+// the command, whatever the command prints becomes the new file content.
+// Starting a new transformation of a file cancels the one still running
+func CommandTransformer(command string) transform.CheckedFileTransformer {
+	return func(path string, content []byte) ([]byte, bool) {
+		ctx, current := start(command, path)
+		defer finish(command, path, current)
+
+		result, err := RunContext(ctx, command, path, content)
+
+		// Superseded by a newer transformation, nothing to report
+		if ctx.Err() == context.Canceled {
+			return content, false
+		}
+
+		if err != nil {
+			diagnostics.Errorf("External Transformer", path, "%s: %s", command, describe(err, result))
+			return content, false
+		}
+
+		if stderr := strings.TrimSpace(string(result.Stderr)); stderr != "" {
+			diagnostics.Warnf("External Transformer", path, "%s: %s", command, stderr)
+		}
+
+		return result.Stdout, true
+	}
+}
+
+// WorkerTransformer creates a transformer that sends the file to a long lived
+// worker process running the command, one process handles every file
+func WorkerTransformer(command string) transform.CheckedFileTransformer {
+	transformerWorker := worker.Get(command, command)
+
+	return func(path string, content []byte) ([]byte, bool) {
+		ctx, current := start(command, path)
+		defer finish(command, path, current)
+
+		if options.ExternalCommandTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, options.ExternalCommandTimeout)
+			defer cancel()
+		}
+
+		response, err := transformerWorker.Transform(ctx, path, content, nil)
+
+		// Superseded by a newer transformation, nothing to report
+		if ctx.Err() == context.Canceled {
+			return content, false
+		}
+
+		response.Report("External Transformer", path)
+
+		if err != nil {
+			diagnostics.Errorf("External Transformer", path, "%s: %s", command, err.Error())
+			return content, false
+		}
+
+		return []byte(response.Content), true
+	}
+}
+
+// CancelAll cancels every external transformation still running
+func CancelAll() {
+	runningLock.Lock()
+	defer runningLock.Unlock()
+
+	for key, r := range running {
+		r.cancel()
+		delete(running, key)
+	}
+}
+
+func start(command string, path string) (context.Context, *run) {
+	ctx, cancel := context.WithCancel(context.Background())
+	current := &run{cancel: cancel}
+
+	runningLock.Lock()
+	if previous, exists := running[command+path]; exists {
+		previous.cancel()
+	}
+	running[command+path] = current
+	runningLock.Unlock()
+
+	return ctx, current
+}
+
+func finish(command string, path string, current *run) {
+	runningLock.Lock()
+	if running[command+path] == current {
+		delete(running, command+path)
+	}
+	runningLock.Unlock()
+
+	current.cancel()
+}
@@ -8,10 +8,12 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/nonanick/impatience/analyzer"
 	"github.com/nonanick/impatience/cache"
+	"github.com/nonanick/impatience/diagnostics"
 	"github.com/nonanick/impatience/options"
 	"github.com/nonanick/impatience/transform"
 )
@@ -29,16 +31,38 @@ type File struct {
 
 	Bytes []byte
 
+	// Transformed Bytes hold the content served, even when empty
+	Transformed bool
+
+	// Etag hash of the content served, weak when the content is generated
 	Etag         string
-	LastModified string
+	WeakEtag     bool
+	LastModified time.Time
 
 	AnalyzedBy    []string
 	TransformedBy []string
 	Dependencies  []string
 
 	Size uint32
+
+	// SourceMap map from Bytes to the file, empty when no transformer
+	// changed it
+	SourceMap []byte
+
+	// Generated the content is produced from the Source file instead of
+	// being read from the file system
+	Generated bool
+	Source    string
+	// InheritDependencies the generated file depends on what its source does
+	InheritDependencies bool
 }
 
+// Generator produces the content of a file generated from source
+type Generator = func(source *File) []byte
+
+// lock guards the maps below, files are processed concurrently
+var lock sync.RWMutex
+
 // knownFiles easy way to check if files is known / being tracked
 var knownFiles = map[string]bool{}
 
@@ -51,9 +75,15 @@ var publicKnownFiles = map[string]bool{}
 // publicMap maps a public path to a real file path
 var publicMap = map[string]string{}
 
+// generators generate the content of generated files, by their path
+var generators = map[string]Generator{}
+
 // All Return all tracked files
 func All() []File {
-	all := make([]File, len(allFiles))
+	lock.RLock()
+	defer lock.RUnlock()
+
+	all := make([]File, 0, len(allFiles))
 	for _, f := range allFiles {
 		all = append(all, f)
 	}
@@ -73,7 +103,7 @@ func Create(file string) (File, error) {
 	mimeType := mime.TypeByExtension(ext)
 
 	fileDef := File{
-		PublicPath: strings.Replace(file, options.PublicRoot, "", 0),
+		PublicPath: PublicURL(file),
 		Path:       file,
 		Dir:        directory,
 		Name:       name,
@@ -83,8 +113,7 @@ func Create(file string) (File, error) {
 		Extension: ext,
 		MimeType:  mimeType,
 
-		LastModified: fileStats.ModTime().String(),
-		Etag:         cache.CalculateHash(file, fileStats.ModTime().String()),
+		LastModified: fileStats.ModTime(),
 
 		AnalyzedBy:    []string{},
 		TransformedBy: []string{},
@@ -93,13 +122,25 @@ func Create(file string) (File, error) {
 		Size: uint32(fileStats.Size()),
 	}
 
-	go processFile(&fileDef)
+	processFile(&fileDef)
+	tagContent(&fileDef, nil)
 
 	return fileDef, nil
 }
 
+// PublicURL return the url of a file inside the public root
+func PublicURL(file string) string {
+	relative, err := filepath.Rel(options.PublicRoot, file)
+	if err != nil {
+		return filepath.ToSlash(file)
+	}
+
+	return "/" + filepath.ToSlash(relative)
+}
+
 // Will transform and analyze the file!
 func processFile(file *File) {
+	diagnostics.Clear(file.Path)
 	applyTransformers(file)
 	analyzeFile(file)
 }
@@ -107,13 +148,43 @@ func processFile(file *File) {
 func applyTransformers(file *File) *File {
 	// Has file transformers associated ?
 	if transform.HasFileTransformer(file.Path) {
-		newContent := transform.Transform(file.Path)
+		newContent, sourceMap := transform.TransformWithMap(file.Path)
 		file.Bytes = newContent
+		file.Transformed = true
+
+		file.SourceMap = []byte{}
+		if sourceMap != nil {
+			file.SourceMap = sourceMap.Encode()
+		}
 	}
 
 	return file
 }
 
+// tagContent sets the etag from the content served, after the transformers
+// ran so a change in the output also changes the tag. The output may change
+// while the source does not (a dependency or the configuration changed), it
+// is then last modified when it was updated
+func tagContent(file *File, previous *File) {
+	file.Etag = cache.ContentHash(file.GetContent())
+	file.WeakEtag = file.Generated
+
+	if previous == nil {
+		return
+	}
+
+	if previous.Etag == file.Etag {
+		if previous.LastModified.After(file.LastModified) {
+			file.LastModified = previous.LastModified
+		}
+		return
+	}
+
+	if !file.LastModified.After(previous.LastModified) {
+		file.LastModified = time.Now()
+	}
+}
+
 func analyzeFile(file *File) *File {
 	if analyzer.HasAssociatedAnalyzer(file.Path) {
 		dependencies := analyzer.AnalyzeFile(file.Path, file.GetContent())
@@ -146,18 +217,16 @@ func Add(file string) (*File, error) {
 		return &File{}, errors.New("Failed to create file definition! " + crtErr.Error())
 	}
 
-	allFiles[file] = fileDef
-	knownFiles[file] = true
-
-	// Update public file information
-	publicKnownFiles[fileDef.PublicPath] = true
-	publicMap[fileDef.PublicPath] = file
+	AddDefinition(fileDef)
 
 	return &fileDef, nil
 }
 
 // AddDefinition add a new file definition
 func AddDefinition(file File) {
+	lock.Lock()
+	defer lock.Unlock()
+
 	allFiles[file.Path] = file
 	knownFiles[file.Path] = true
 
@@ -166,26 +235,125 @@ func AddDefinition(file File) {
 	publicMap[file.PublicPath] = file.Path
 }
 
+// AddGenerated adds a file whose content is generated from a known source
+// file, the content is generated again whenever the source is updated. An
+// empty source generates a file that only exists in memory. A file standing
+// for its source (a proxy module) inherits the dependencies of the source
+func AddGenerated(
+	path string,
+	source string,
+	publicPath string,
+	mimeType string,
+	inheritDependencies bool,
+	generate Generator,
+) (*File, error) {
+	if source != "" && !IsKnown(source) {
+		return &File{}, errors.New("Cannot generate " + path + " from unknown file " + source)
+	}
+
+	fileDef := File{
+		PublicPath: publicPath,
+		Path:       path,
+		Name:       filepath.Base(path),
+		Extension:  filepath.Ext(path),
+		MimeType:   mimeType,
+
+		AnalyzedBy:    []string{},
+		TransformedBy: []string{},
+
+		Generated:           true,
+		Source:              source,
+		InheritDependencies: inheritDependencies,
+	}
+
+	lock.Lock()
+	generators[path] = generate
+	lock.Unlock()
+
+	generateFile(&fileDef, nil)
+	AddDefinition(fileDef)
+
+	return &fileDef, nil
+}
+
+// generateFile generates the content of a generated file from its source,
+// which also provides its dependencies
+func generateFile(file *File, previous *File) {
+	source := Get(file.Source)
+
+	lock.RLock()
+	generate := generators[file.Path]
+	lock.RUnlock()
+
+	file.Bytes = generate(source)
+	file.Transformed = true
+	file.Size = uint32(len(file.Bytes))
+	file.Dir = source.Dir
+	file.Dependencies = []string{}
+	if file.InheritDependencies {
+		file.Dependencies = source.Dependencies
+	}
+	file.LastModified = source.LastModified
+	tagContent(file, previous)
+}
+
+// updateGenerated generates again the files generated from source
+func updateGenerated(source string) {
+	lock.RLock()
+	generated := []string{}
+	for path, file := range allFiles {
+		if file.Generated && file.Source == source {
+			generated = append(generated, path)
+		}
+	}
+	lock.RUnlock()
+
+	for _, path := range generated {
+		Update(path)
+	}
+}
+
 // Update asks for the system to update a file definition
 func Update(file string) (*File, error) {
 
+	if IsKnown(file) && Get(file).Generated {
+		previous := *Get(file)
+		fileInfo := previous
+		generateFile(&fileInfo, &previous)
+
+		lock.Lock()
+		allFiles[file] = fileInfo
+		lock.Unlock()
+
+		return &fileInfo, nil
+	}
+
 	if IsKnown(file) {
-		fileInfo := allFiles[file]
+		previous := *Get(file)
+		fileInfo := previous
 
-		// Update LastModified and ETag
-		fileInfo.LastModified = time.Now().String()
-		fileInfo.Etag = cache.CalculateHash(file, fileInfo.LastModified)
+		if fileStats, statErr := os.Stat(file); statErr == nil {
+			fileInfo.LastModified = fileStats.ModTime()
+			fileInfo.Size = uint32(fileStats.Size())
+		}
 
 		fileInfo.Bytes = []byte{}
+		fileInfo.Transformed = false
 		fileInfo.Dependencies = []string{}
+		diagnostics.Clear(file)
 
 		// Reapply transformers
 		applyTransformers(&fileInfo)
 
 		// Dependencies need to be updated aswell!
 		analyzeFile(&fileInfo)
+		tagContent(&fileInfo, &previous)
 
+		lock.Lock()
 		allFiles[file] = fileInfo
+		lock.Unlock()
+
+		updateGenerated(file)
 
 		return &fileInfo, nil
 	}
@@ -194,26 +362,55 @@ func Update(file string) (*File, error) {
 
 }
 
+// Invalidate updates every known file accepted by the filter, used when a
+// configuration change affects the transformation of already known files
+func Invalidate(filter func(file *File) bool) {
+	lock.RLock()
+	affected := []string{}
+	for path, file := range allFiles {
+		if filter(&file) {
+			affected = append(affected, path)
+		}
+	}
+	lock.RUnlock()
+
+	for _, path := range affected {
+		Update(path)
+	}
+}
+
 // Remove removes a file from the Known files, it will not delete the file from
 // file system
 func Remove(file string) {
+	lock.Lock()
+	defer lock.Unlock()
+
 	knownFiles[file] = false
 	delete(allFiles, file)
 }
 
 // IsKnown either the file is known to Impatience
 func IsKnown(file string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+
 	return knownFiles[file] != false
 }
 
 // IsPubliclyKnown if the  public path is known to Impatience
 func IsPubliclyKnown(publicPath string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+
 	return publicKnownFiles[publicPath] != false
 }
 
 // Get will return a File definition or nil if the file
 // is not known
 func Get(file string) *File {
+	lock.RLock()
+	defer lock.RUnlock()
+
 	f := allFiles[file]
 	return &f
 }
@@ -221,16 +418,22 @@ func Get(file string) *File {
 // GetPublic return a file definition or nil if the file is not found
 // using its public path
 func GetPublic(publicPath string) *File {
+	lock.RLock()
 	fPath := publicMap[publicPath]
+	lock.RUnlock()
+
 	return Get(fPath)
 }
 
-// MapEtags return all known etags
+// MapEtags return all known etags by the public path of their file
 func MapEtags() map[string]string {
+	lock.RLock()
+	defer lock.RUnlock()
+
 	var etags = map[string]string{}
 
-	for path, file := range allFiles {
-		etags[path] = file.Etag
+	for _, file := range allFiles {
+		etags[file.PublicPath] = file.Etag
 	}
 
 	return etags
@@ -238,6 +441,9 @@ func MapEtags() map[string]string {
 
 // RecognizeEtag check if the etag is known to files
 func RecognizeEtag(tag string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+
 	for _, file := range allFiles {
 		if file.Etag == tag {
 			return true
@@ -247,10 +453,19 @@ func RecognizeEtag(tag string) bool {
 	return false
 }
 
+// EtagHeader etag as sent in the ETag header, quoted and prefixed by W/ when
+// weak
+func (f *File) EtagHeader() string {
+	if f.WeakEtag {
+		return `W/"` + f.Etag + `"`
+	}
+	return `"` + f.Etag + `"`
+}
+
 // WasTransformed check if the file was transformed and have
 // its transformed bytes on memory
 func (f *File) WasTransformed() bool {
-	return len(f.Bytes) > 0
+	return f.Transformed
 }
 
 // TrueSize return the size of the bytes that shall be transferred
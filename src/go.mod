@@ -3,6 +3,7 @@ module github.com/nonanick/impatience
 go 1.15
 
 require (
+	github.com/evanw/esbuild v0.25.10
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/kr/pretty v0.2.1
 )
@@ -9,18 +9,26 @@ func Help(args []string) {
 		"	- Avaliable sub commands:\n",
 		"		º launch\n",
 		"		º init\n",
+		"		º cache\n",
 		"		º help\n",
 		"------------------------------------------\n\n",
 		// Launch
 		"# command \"launch\": \n",
 		"Launches a new web server.\n",
 		"	--address, -a  server address\n",
-		"	--cache, -s    cache strategy, as of now only \"cookie\" is valid\n",
+		"	--cache, -s    cache strategy, \"cookie\" or \"digest\" (pages register the\n",
+		"	               service worker /_impatience-cache-digest.js)\n",
 		"	--config, -c   path for a JSON configuration\n",
 		"	--node, -n     path to node_modules root\n",
 		"	--node-ext     file extensions that shall be analyzed looking for node libraries\n",
 		"	--port, -p     TCP port the server shall be launched in\n",
 		"	--root, -r     public root that shall be served by Impatience\n",
 		"	--ts           enable ts support, you may specify the path to tsconfig\n",
+		"------------------------------------------\n\n",
+		// Cache
+		"# command \"cache\": \n",
+		"Shows the size of the transform cache.\n",
+		"	clean          removes every cached transformer output\n",
+		"	--config, -c   path for a JSON configuration\n",
 	)
 }
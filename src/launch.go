@@ -1,71 +1,269 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 
+	"github.com/kr/pretty"
 	"github.com/nonanick/impatience/analyzer/css"
 	"github.com/nonanick/impatience/analyzer/html"
 	"github.com/nonanick/impatience/analyzer/javascript"
+	"github.com/nonanick/impatience/cache"
 	"github.com/nonanick/impatience/crawler"
+	"github.com/nonanick/impatience/external"
+	"github.com/nonanick/impatience/files"
 	"github.com/nonanick/impatience/options"
 	"github.com/nonanick/impatience/pathresolver"
 	"github.com/nonanick/impatience/server"
+	"github.com/nonanick/impatience/transform"
+	"github.com/nonanick/impatience/transform/cssmodules"
+	"github.com/nonanick/impatience/transform/define"
+	"github.com/nonanick/impatience/transform/imports"
 	"github.com/nonanick/impatience/transform/nodemodules"
 	"github.com/nonanick/impatience/transform/typescript"
+	"github.com/nonanick/impatience/transform/worker"
 	"github.com/nonanick/impatience/watcher"
 )
 
 // Launch will launch a new https server
 func Launch(args []string) {
 
-	// Get wd from running proccess
-	wd, wdErr := os.Getwd()
-	if wdErr != nil {
-		log.Fatalln("Working directory could not be reached!", wdErr)
-	}
-
 	// Declare options
-	options.Use(options.Default)
+	declareOptions()
 
-	// Build the absolute path from wd + given path
-	absPath := filepath.Join(wd, "..", "public")
-	options.PublicRoot = absPath
-	options.NodeModulesRoot = filepath.Join("node_modules")
+	// The configuration file and command line flags override them
+	parseFlags("launch", args)
+
+	// Pick how the files cached by the client are known
+	useCacheStrategy()
 
 	// Add file analyzers
 	javascript.Register()
 	html.Register()
 	css.Register()
+	external.RegisterAnalyzers()
 
 	// Add file transformers
 	typescript.Register()
+	define.Register()
 	nodemodules.Register()
+	imports.Register()
+	cssmodules.Register()
+	external.RegisterTransformers()
+	transform.CheckPipelines()
+
+	// Bundle heavy node packages before files start importing them
+	nodemodules.Prebundle()
 
 	// Crawl public directory and
 	// -- add all the known files
 	// -- apply all file transformers
 	// -- use all analyzers to determine dependencies
-	crawler.Crawl(absPath)
+	crawler.Crawl(options.PublicRoot)
 
 	// Add configurations to HTTP2 server
 	server.Configure(
 		&server.ImpatienceConfig{
 			Port: 443,
-			Root: absPath,
+			Root: options.PublicRoot,
 		},
 	)
 
-	// Add path resolvers - Absolute, Relative, With Index, With Extension
+	// Add path resolvers - Absolute, Relative, With Index, With Extension, With Source Extension, Node Module, With Query
 	pathresolver.AddResolver(pathresolver.Absolute)
 	pathresolver.AddResolver(pathresolver.Relative)
 	pathresolver.AddResolver(pathresolver.WithIndex)
 	pathresolver.AddResolver(pathresolver.WithExtension)
+	pathresolver.AddResolver(pathresolver.WithSourceExtension)
+	pathresolver.AddResolver(pathresolver.NodeModule)
+	pathresolver.AddResolver(pathresolver.WithSourceMap)
+	pathresolver.AddResolver(pathresolver.WithQuery)
 
 	// Start fs watcher
 	go watcher.Watch()
 
+	// Stop transformer workers before exiting
+	go shutdownOnSignal()
+
 	// Run Server
 	server.Launch()
 }
+
+// declareOptions uses the default options with the project folders, the
+// public root is the "public" folder next to the working directory
+func declareOptions() {
+
+	// Get wd from running proccess
+	wd, wdErr := os.Getwd()
+	if wdErr != nil {
+		log.Fatalln("Working directory could not be reached!", wdErr)
+	}
+
+	options.Use(options.Default)
+
+	// Build the absolute path from wd + given path
+	absPath := filepath.Join(wd, "..", "public")
+	options.PublicRoot = absPath
+	options.NodeModulesRoot = filepath.Join("node_modules")
+}
+
+// parseFlags applies the configuration file given by --config and then the
+// other flags, the arguments that are not flags are returned
+func parseFlags(command string, args []string) []string {
+	var config, cacheStrategy, tsConfig string
+
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	flags.StringVar(&config, "config", "", "path for a JSON configuration")
+	flags.StringVar(&config, "c", "", "shorthand for --config")
+	flags.Var(tsConfigFlag{&tsConfig}, "ts", "enable ts support, you may specify the path to tsconfig")
+	flags.StringVar(&cacheStrategy, "cache", "", "cache strategy, \"cookie\" or \"digest\"")
+	flags.StringVar(&cacheStrategy, "s", "", "shorthand for --cache")
+
+	known, rest := knownFlags(flags, args)
+	flags.Parse(known)
+
+	if config != "" {
+		if err := options.Load(config); err != nil {
+			log.Fatalln("Could not load the configuration", err)
+		}
+
+		absRoot, err := filepath.Abs(options.PublicRoot)
+		if err != nil {
+			log.Fatalln("Invalid public root", options.PublicRoot, err)
+		}
+		options.PublicRoot = absRoot
+	}
+
+	flags.Visit(func(set *flag.Flag) {
+		switch set.Name {
+		case "cache", "s":
+			options.CacheStrategy = cacheStrategy
+		case "ts":
+			if tsConfig != "" {
+				options.TsConfigPath = tsConfig
+			}
+		}
+	})
+
+	return rest
+}
+
+// tsConfigFlag value of --ts, given alone it keeps the default tsconfig path
+type tsConfigFlag struct {
+	path *string
+}
+
+func (value tsConfigFlag) String() string {
+	if value.path == nil {
+		return ""
+	}
+	return *value.path
+}
+
+func (value tsConfigFlag) Set(path string) error {
+	if path != "true" {
+		*value.path = path
+	}
+	return nil
+}
+
+func (value tsConfigFlag) IsBoolFlag() bool {
+	return true
+}
+
+// knownFlags splits the arguments of the flags defined in the set from the
+// arguments that are not flags, the other flags are skipped with their value
+// instead of stopping the command. A value following a flag that may be given
+// alone (--ts path) is joined to it
+func knownFlags(flags *flag.FlagSet, args []string) ([]string, []string) {
+	known := []string{}
+	rest := []string{}
+
+	for index := 0; index < len(args); index++ {
+		arg := args[index]
+		if arg == "--" {
+			return known, append(rest, args[index+1:]...)
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			rest = append(rest, arg)
+			continue
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		withValue := strings.Contains(name, "=")
+		if withValue {
+			name = name[:strings.Index(name, "=")]
+		}
+		valueFollows := !withValue && index+1 < len(args) && !strings.HasPrefix(args[index+1], "-")
+
+		defined := flags.Lookup(name)
+		if defined == nil {
+			pretty.Println("Ignoring unsupported flag", arg)
+			if valueFollows {
+				index++
+			}
+			continue
+		}
+
+		optional, ok := defined.Value.(interface{ IsBoolFlag() bool })
+		if ok && optional.IsBoolFlag() {
+			if valueFollows {
+				arg += "=" + args[index+1]
+				index++
+			}
+		} else if !withValue && index+1 < len(args) {
+			arg += "=" + args[index+1]
+			index++
+		}
+
+		known = append(known, arg)
+	}
+
+	return known, rest
+}
+
+// useCacheStrategy changes the cache strategy to options.CacheStrategy, the
+// digest strategy also serves the service worker sending the digests
+func useCacheStrategy() {
+	strategy, known := cache.Strategies[options.CacheStrategy]
+	if !known {
+		log.Fatalln("Unknown cache strategy", options.CacheStrategy)
+	}
+	cache.ChangeStrategy(strategy)
+
+	if options.CacheStrategy != "digest" {
+		return
+	}
+
+	_, err := files.AddGenerated(
+		filepath.Join(options.PublicRoot, filepath.FromSlash(cache.DigestWorkerURL)),
+		"",
+		cache.DigestWorkerURL,
+		"text/javascript",
+		false,
+		func(source *files.File) []byte {
+			return cache.DigestWorker()
+		},
+	)
+	if err != nil {
+		log.Fatalln("Could not serve the cache digest worker", err)
+	}
+}
+
+// shutdownOnSignal gracefully stops running transformers when the process
+// is asked to stop
+func shutdownOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	log.Println("Shutting down Impatience...")
+	external.CancelAll()
+	worker.ShutdownAll()
+	os.Exit(0)
+}
@@ -43,6 +43,7 @@ type ImpatienceCLICommand = func(args []string)
 var ImpatienceCommands map[string]ImpatienceCLICommand = map[string]ImpatienceCLICommand{
 	"launch": Launch,
 	"help":   Help,
+	"cache":  Cache,
 	"init": func(args []string) {
 		pretty.Println(
 			"[Impatience - Init]:\n",
@@ -1,13 +1,43 @@
 package options
 
+import "time"
+
 // Default default Impatience options
 var Default = ImpatienceOptions{
+	CacheStrategy:          "cookie",
 	CacheCookieName:        "_ImpatienceCache",
-	CacheFilenameSeparator: "_&_",
+	CacheCookieBudget:      8000,
+	CacheFalsePositiveRate: 0.01,
 	ExternalAnalyzers:      map[string]string{},
-	ExternalTransformers:   map[string]string{},
-	UseNodeModules:         true,
-	NodeModulesRoot:        "node_modules",
+	ExternalTransformers:   map[string]ExternalTransformer{},
+	ExternalCommandTimeout: 10 * time.Second,
+	TypescriptTranspiler:   "native",
+	TsConfigPath:           "tsconfig.json",
+	Define: map[string]string{
+		"process.env.NODE_ENV": "\"development\"",
+	},
+	EnvFiles:           []string{".env", ".env.local"},
+	EnvPrefix:          "IMPATIENCE_",
+	TransformCache:     true,
+	TransformCacheDir:  ".impatience/cache",
+	TransformCacheSize: 256 << 20,
+	UseNodeModules:     true,
+	NodeModulesRoot:    "node_modules",
+	NodeModulesMode:    "rewrite",
+	NodeShims: map[string]string{
+		"assert":         "assert",
+		"buffer":         "buffer",
+		"events":         "events",
+		"path":           "path-browserify",
+		"process":        "process",
+		"punycode":       "punycode",
+		"querystring":    "querystring-es3",
+		"stream":         "stream-browserify",
+		"string_decoder": "string_decoder",
+		"url":            "url",
+		"util":           "util",
+	},
+	ShimNodeGlobals:        true,
 	SearchForNodeModulesIn: []string{".js", ".ts", ".jsx", ".tsx", ".vue"},
 	TLSCertificateFile:     "./ssl/cert.pem",
 	TLSKeyFile:             "./ssl/key.pem",
@@ -1,6 +1,13 @@
 // Package options hold configurations that are used by the Impatience Server
 package options
 
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"time"
+)
+
 // PublicRoot hold the absolute path pointing to the folder that shall be
 // served by Impatience
 var PublicRoot string
@@ -14,8 +21,19 @@ var ServerPort uint16
 // CacheCookieName name of the cookie used by the cookie cache strategy
 var CacheCookieName string
 
-// CacheFilenameSeparator string that will separate cached etags
-var CacheFilenameSeparator string
+// CacheStrategy how the server learns which files the client cached, so
+// they are not pushed again: "cookie" keeps their etags in cookies, "digest"
+// reads the Cache-Digest header sent by the service worker Impatience serves
+var CacheStrategy string
+
+// CacheCookieBudget bytes the cookie cache strategy may use, split across
+// as many cookies as needed. Past it the files cached by earlier responses
+// are forgotten first
+var CacheCookieBudget int
+
+// CacheFalsePositiveRate probability of a file being taken as cached by the
+// client when it is not, a lower rate uses more bytes per file
+var CacheFalsePositiveRate float64
 
 // TLSCertificateFile path to the TLS Certificate file
 var TLSCertificateFile string
@@ -25,9 +43,10 @@ var TLSKeyFile string
 
 // ExternalTransformers hold file transformers that live outside Go
 // the map key is the extension (with the dot) that shall use the transformer
-// the value is the command to be run, the transformer must output the file
+// the value describes the command to be run, the file content is passed
+// in the process input, the transformer must output the new file
 // contents to the process output and the ExitCode must be 0!
-var ExternalTransformers map[string]string
+var ExternalTransformers map[string]ExternalTransformer
 
 // ExternalAnalyzers hold file analyzers that live outside Go
 // the map key is the extension (with the dot) that shall be analyzed
@@ -36,6 +55,64 @@ var ExternalTransformers map[string]string
 // must be 0!
 var ExternalAnalyzers map[string]string
 
+// ExternalCommandTimeout max amount of time an external analyzer/transformer
+// is allowed to run before being killed
+var ExternalCommandTimeout time.Duration
+
+// TypescriptTranspiler which transpiler is used for typescript files:
+// "native" transpiles inside the Impatience process, falling back to node
+// when it fails, "node" always uses the 'typescript' package through node
+var TypescriptTranspiler string
+
+// TsConfigPath path of the tsconfig used to transpile typescript files,
+// its "compilerOptions" (following "extends") are passed to the transpiler
+var TsConfigPath string
+
+// JSXRuntime how JSX in .jsx/.tsx files is compiled: "automatic" imports
+// the jsx functions from "<JSXImportSource>/jsx-runtime", "classic" calls
+// JSXFactory/JSXFragment. When empty the tsconfig "jsx" option is used
+var JSXRuntime string
+
+// JSXImportSource package providing the automatic jsx runtime, "react" by
+// default, "preact" for Preact
+var JSXImportSource string
+
+// JSXFactory function called for each element by the classic runtime, for
+// example "h" for Preact
+var JSXFactory string
+
+// JSXFragment expression used for fragments by the classic runtime
+var JSXFragment string
+
+// Define expressions replaced in javascript output, each key (an
+// identifier or member chain like "process.env.NODE_ENV") is replaced by
+// its value, a javascript expression
+var Define map[string]string
+
+// EnvFiles .env files loaded in order, later files override earlier ones
+var EnvFiles []string
+
+// EnvPrefix only variables starting with this prefix are exposed through
+// "import.meta.env" and "process.env"
+var EnvPrefix string
+
+// Pipelines rules choosing the transformers of the files they match, the
+// first matching rule wins and files matching no rule are served untouched.
+// Without rules every file goes through the transformers of its extension
+var Pipelines []Pipeline
+
+// TransformCache keeps the output of cacheable transformers on disk, a
+// warm launch reuses them instead of transforming the files again
+var TransformCache bool
+
+// TransformCacheDir folder of the transform cache, relative to the
+// node_modules root unless absolute
+var TransformCacheDir string
+
+// TransformCacheSize bytes the transform cache may use before the least
+// recently used outputs are evicted, 0 disables the limit
+var TransformCacheSize int64
+
 // UseNodeModules instructs Impatience to expose the required node
 // libraries using the fake URL /__impatience/node/:library
 var UseNodeModules bool
@@ -45,6 +122,27 @@ var UseNodeModules bool
 // URL /__impatience/node/:library
 var SearchForNodeModulesIn []string
 
+// NodeModulesMode how bare specifiers reach the browser: "rewrite" replaces
+// them with the url of the resolved file, "importmap" keeps them and injects
+// an import map into served html files
+var NodeModulesMode string
+
+// PrebundlePackages packages bundled into a single module on startup, their
+// entry point is then served from that bundle
+var PrebundlePackages []string
+
+// PrebundleThreshold project dependencies with at least this amount of
+// modules are pre-bundled as well, 0 disables the detection
+var PrebundleThreshold int
+
+// NodeShims maps node built-in modules to the browser package replacing
+// them, built-ins without a package (or mapped to "") become empty modules
+var NodeShims map[string]string
+
+// ShimNodeGlobals defines "process", "global" and "Buffer" for node_modules
+// files that use them
+var ShimNodeGlobals bool
+
 // NodeModulesRoot specifies the absolute path to the node_modules folder
 // that shall be used
 var NodeModulesRoot string
@@ -62,23 +160,106 @@ var WatchFiles bool
 type ImpatienceOptions struct {
 	PublicRoot string
 
+	CacheStrategy          string
 	CacheCookieName        string
-	CacheFilenameSeparator string
+	CacheCookieBudget      int
+	CacheFalsePositiveRate float64
 
 	TLSCertificateFile string
 	TLSKeyFile         string
 
-	ExternalTransformers map[string]string
+	ExternalTransformers map[string]ExternalTransformer
 	ExternalAnalyzers    map[string]string
 
+	ExternalCommandTimeout time.Duration
+
+	TypescriptTranspiler string
+	TsConfigPath         string
+
+	JSXRuntime      string
+	JSXImportSource string
+	JSXFactory      string
+	JSXFragment     string
+
+	Define    map[string]string
+	EnvFiles  []string
+	EnvPrefix string
+
+	Pipelines []Pipeline
+
+	TransformCache     bool
+	TransformCacheDir  string
+	TransformCacheSize int64
+
 	UseNodeModules         bool
 	SearchForNodeModulesIn []string
 	NodeModulesRoot        string
+	NodeModulesMode        string
+	PrebundlePackages      []string
+	PrebundleThreshold     int
+	NodeShims              map[string]string
+	ShimNodeGlobals        bool
 
 	UseHotReload bool
 	WatchFiles   bool
 }
 
+// ExternalTransformer command that transforms files outside Go
+type ExternalTransformer struct {
+	// Command to be run, the file path is passed as its last argument
+	Command string
+	// MimeType of the transformed output, when empty the mime type of the
+	// original extension is kept
+	MimeType string
+	// Extension of the transformed output (with the dot), when empty the
+	// original extension is kept
+	Extension string
+	// Worker the command is a long lived process that speaks the worker
+	// protocol (see package transform/worker) instead of being run once
+	// per file
+	Worker bool
+	// NoCache the output depends on more than the file content, it is never
+	// kept in the transform cache
+	NoCache bool
+}
+
+// Pipeline transformers applied to the files matching a glob, for example
+// {"match": "src/legacy/**/*.js", "transformers": ["cjs-interop", "define"]}
+type Pipeline struct {
+	// Match glob relative to the public root, "**" matches any amount of
+	// folders and globs without "/" match the file name
+	Match string `json:"match"`
+	// Transformers names of the transformers, run in the listed order. "*"
+	// stands for every transformer of the file extension
+	Transformers []string `json:"transformers"`
+}
+
+// Load reads a JSON configuration with the fields of ImpatienceOptions and
+// uses it, the options it leaves out keep their default value
+func Load(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Decoded over a copy of the defaults, leaving Default untouched
+	config := ImpatienceOptions{}
+	defaults, err := json.Marshal(Default)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(defaults, &config); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(content, &config); err != nil {
+		return errors.New("Invalid configuration " + path + ": " + err.Error())
+	}
+
+	Use(config)
+	return nil
+}
+
 // Use a set of options, if the value corresponds to the zero value
 // it shall be ignored
 func Use(options ImpatienceOptions) {
@@ -86,12 +267,20 @@ func Use(options ImpatienceOptions) {
 		PublicRoot = options.PublicRoot
 	}
 
+	if options.CacheStrategy != "" {
+		CacheStrategy = options.CacheStrategy
+	}
+
 	if options.CacheCookieName != "" {
 		CacheCookieName = options.CacheCookieName
 	}
 
-	if options.CacheFilenameSeparator != "" {
-		CacheFilenameSeparator = options.CacheFilenameSeparator
+	if options.CacheCookieBudget != 0 {
+		CacheCookieBudget = options.CacheCookieBudget
+	}
+
+	if options.CacheFalsePositiveRate != 0 {
+		CacheFalsePositiveRate = options.CacheFalsePositiveRate
 	}
 
 	if options.TLSCertificateFile != "" {
@@ -110,15 +299,85 @@ func Use(options ImpatienceOptions) {
 		ExternalAnalyzers = options.ExternalAnalyzers
 	}
 
+	if options.ExternalCommandTimeout != 0 {
+		ExternalCommandTimeout = options.ExternalCommandTimeout
+	}
+
+	if options.TypescriptTranspiler != "" {
+		TypescriptTranspiler = options.TypescriptTranspiler
+	}
+
+	if options.TsConfigPath != "" {
+		TsConfigPath = options.TsConfigPath
+	}
+
+	if options.JSXRuntime != "" {
+		JSXRuntime = options.JSXRuntime
+	}
+
+	if options.JSXImportSource != "" {
+		JSXImportSource = options.JSXImportSource
+	}
+
+	if options.JSXFactory != "" {
+		JSXFactory = options.JSXFactory
+	}
+
+	if options.JSXFragment != "" {
+		JSXFragment = options.JSXFragment
+	}
+
 	if options.SearchForNodeModulesIn != nil {
 		SearchForNodeModulesIn = options.SearchForNodeModulesIn
 	}
 
+	if options.Define != nil {
+		Define = options.Define
+	}
+
+	if options.EnvFiles != nil {
+		EnvFiles = options.EnvFiles
+	}
+
+	if options.EnvPrefix != "" {
+		EnvPrefix = options.EnvPrefix
+	}
+
+	if options.Pipelines != nil {
+		Pipelines = options.Pipelines
+	}
+
+	if options.TransformCacheDir != "" {
+		TransformCacheDir = options.TransformCacheDir
+	}
+
+	if options.TransformCacheSize != 0 {
+		TransformCacheSize = options.TransformCacheSize
+	}
+
 	if options.NodeModulesRoot != "" {
 		NodeModulesRoot = options.NodeModulesRoot
 	}
 
+	if options.NodeModulesMode != "" {
+		NodeModulesMode = options.NodeModulesMode
+	}
+
+	if options.PrebundlePackages != nil {
+		PrebundlePackages = options.PrebundlePackages
+	}
+
+	if options.PrebundleThreshold != 0 {
+		PrebundleThreshold = options.PrebundleThreshold
+	}
+
+	if options.NodeShims != nil {
+		NodeShims = options.NodeShims
+	}
+
 	UseNodeModules = options.UseNodeModules
+	ShimNodeGlobals = options.ShimNodeGlobals
+	TransformCache = options.TransformCache
 	UseHotReload = options.UseHotReload
 	WatchFiles = options.WatchFiles
 }
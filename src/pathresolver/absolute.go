@@ -3,6 +3,7 @@ package pathresolver
 import (
 	"errors"
 	"path/filepath"
+	"strings"
 
 	"github.com/nonanick/impatience/files"
 )
@@ -21,9 +22,10 @@ func Absolute(
 	}
 
 	// Absolute public dir
-	if path[0] == '/' {
-		if files.IsPubliclyKnown(public) {
-			f := files.GetPublic(public)
+	if strings.HasPrefix(path, "/") {
+		publicPath := strings.TrimPrefix(filepath.ToSlash(path), filepath.ToSlash(public))
+		if files.IsPubliclyKnown(publicPath) {
+			f := files.GetPublic(publicPath)
 			return f.Path, nil
 		}
 	}
@@ -0,0 +1,33 @@
+package pathresolver
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nonanick/impatience/transform/nodemodules"
+)
+
+// NodeModule resolves urls under nodemodules.NodePublicRoot that are not
+// known yet, exposing the node_modules file they point to
+func NodeModule(
+	path string,
+	public string,
+) (string, error) {
+
+	url := strings.TrimPrefix(filepath.ToSlash(path), filepath.ToSlash(public))
+
+	file, err := nodemodules.FileOf(url)
+	if err != nil {
+		return "", err
+	}
+
+	if info, statErr := os.Stat(file); statErr != nil || info.IsDir() {
+		return "", errors.New("Could not locate node module file " + url)
+	}
+
+	nodemodules.ExposeFile(file)
+
+	return file, nil
+}
@@ -0,0 +1,34 @@
+package pathresolver
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nonanick/impatience/transform/imports"
+)
+
+// WithQuery resolves urls with a query string, proxy variants ("?import")
+// resolve to the generated proxy module of the file and any other query is
+// ignored
+func WithQuery(
+	path string,
+	public string,
+) (string, error) {
+
+	query := strings.Index(path, "?")
+	if query < 0 {
+		return "", errors.New("Path has no query string")
+	}
+
+	resolved, err := Resolve(path[:query], public)
+	if err != nil {
+		return "", err
+	}
+
+	variant := path[query+1:]
+	if !imports.IsVariant(variant) {
+		return resolved, nil
+	}
+
+	return imports.Generate(resolved, variant)
+}
@@ -0,0 +1,36 @@
+package pathresolver
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/nonanick/impatience/files"
+	"github.com/nonanick/impatience/transform"
+)
+
+// WithSourceExtension Tries to resolve the url of a transformed output to its
+// source file, "util.js" resolves to "util.ts" since typescript files are
+// served as ".js"
+func WithSourceExtension(
+	path string,
+	public string,
+) (string, error) {
+
+	if !strings.HasPrefix(path, public) {
+		path = filepath.Join(public, path)
+	}
+
+	extension := filepath.Ext(path)
+	withoutExtension := strings.TrimSuffix(path, extension)
+
+	for _, sourceExtension := range transform.SourceExtensions(extension) {
+		withSource := withoutExtension + sourceExtension
+
+		if files.IsKnown(withSource) {
+			return withSource, nil
+		}
+	}
+
+	return "", errors.New("Could not locate the source of path inside known files")
+}
@@ -0,0 +1,55 @@
+package pathresolver
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/nonanick/impatience/files"
+)
+
+// SourceMapSuffix appended to the url of a transformed file to get its
+// source map
+const SourceMapSuffix = ".map"
+
+// WithSourceMap resolves "<url>.map" to the source map of the transformed
+// file served at url, the map is a file generated from the transformed one
+func WithSourceMap(
+	path string,
+	public string,
+) (string, error) {
+
+	if !strings.HasSuffix(path, SourceMapSuffix) {
+		return "", errors.New("Path is not a source map")
+	}
+
+	resolved, err := Resolve(strings.TrimSuffix(path, SourceMapSuffix), public)
+	if err != nil {
+		return "", err
+	}
+
+	generated := resolved + SourceMapSuffix
+	if files.IsKnown(generated) {
+		return generated, nil
+	}
+
+	source := files.Get(resolved)
+	if len(source.SourceMap) == 0 {
+		return "", errors.New("File " + resolved + " has no source map")
+	}
+
+	_, err = files.AddGenerated(
+		generated,
+		resolved,
+		source.PublicPath+SourceMapSuffix,
+		"application/json",
+		false,
+		func(source *files.File) []byte {
+			return source.SourceMap
+		},
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return generated, nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nonanick/impatience/files"
+)
+
+// entityTag etag parsed from a request header
+type entityTag struct {
+	Opaque string
+	Weak   bool
+}
+
+// isNotModified evaluates the conditional headers of a GET or HEAD request
+// against the file (RFC 9110, section 13.2.2). If-Modified-Since is ignored
+// when If-None-Match is present
+func isNotModified(request *http.Request, file *files.File) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		return false
+	}
+
+	if noneMatch := request.Header.Values("If-None-Match"); len(noneMatch) > 0 {
+		return matchesNoneMatch(noneMatch, file)
+	}
+
+	modifiedSince := request.Header.Get("If-Modified-Since")
+	if modifiedSince == "" || file.LastModified.IsZero() {
+		return false
+	}
+
+	since, err := http.ParseTime(modifiedSince)
+	if err != nil {
+		return false
+	}
+
+	// Last-Modified is sent with a precision of seconds
+	return !file.LastModified.Truncate(time.Second).After(since)
+}
+
+// matchesNoneMatch an etag of the If-None-Match header values matches the
+// file, using the weak comparison
+func matchesNoneMatch(values []string, file *files.File) bool {
+	for _, value := range values {
+		if strings.TrimSpace(value) == "*" {
+			return true
+		}
+
+		for _, tag := range parseEntityTags(value) {
+			if tag.Opaque == file.Etag {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// hasValidators the request carries validators of a cached response
+func hasValidators(request *http.Request) bool {
+	return request.Header.Get("If-None-Match") != "" ||
+		request.Header.Get("If-Modified-Since") != ""
+}
+
+// parseEntityTags parses a comma separated list of etags, malformed entries
+// are skipped
+func parseEntityTags(value string) []entityTag {
+	tags := []entityTag{}
+
+	for len(value) > 0 {
+		value = strings.TrimLeft(value, " \t,")
+		if value == "" {
+			break
+		}
+
+		tag := entityTag{}
+		if strings.HasPrefix(value, "W/") {
+			tag.Weak = true
+			value = value[2:]
+		}
+
+		if !strings.HasPrefix(value, `"`) {
+			// Skip up to the next entry
+			next := strings.IndexByte(value, ',')
+			if next < 0 {
+				break
+			}
+			value = value[next:]
+			continue
+		}
+
+		end := strings.IndexByte(value[1:], '"')
+		if end < 0 {
+			break
+		}
+
+		tag.Opaque = value[1 : end+1]
+		tags = append(tags, tag)
+		value = value[end+2:]
+	}
+
+	return tags
+}
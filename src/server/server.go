@@ -5,7 +5,6 @@ import (
 	"log"
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/kr/pretty"
 	"github.com/nonanick/impatience/cache"
@@ -17,7 +16,6 @@ import (
 const (
 	HeaderInstructionNoPush = "X-No-Further-Pushs"
 	CookieCachedFilesName   = "ImpatienceCacheState"
-	CookieFileSeparator     = "_&_"
 )
 
 // Port which will be used to run Impatience Server
@@ -100,13 +98,14 @@ func handlePushableRequest(
 	}
 
 	var requestedFile = files.Get(path)
-	var servedFiles = []string{}
+	var pushedEtags = []string{}
 	var cachedFiles = cache.Extract(
 		request,
 		files.MapEtags(),
 	)
 
-	if !isPushRequest(request) {
+	// A HEAD request only asks for the headers, nothing is pushed
+	if !isPushRequest(request) && request.Method != http.MethodHead {
 		var totalSize uint32 = 0
 		fileDeps := FlattenDependencies(requestedFile, 0, map[string]bool{}, &totalSize)
 		pretty.Println("All file dependencies flattened", fileDeps)
@@ -117,86 +116,72 @@ func handlePushableRequest(
 
 				pushFile(push, depFileInfo, filePush, cachedFiles)
 
-				servedFiles = append(servedFiles, filePush)
+				pushedEtags = append(pushedEtags, depFileInfo.Etag)
 			} else {
 				fmt.Println("WARN: File", path, "declares the dependency", filePush, "but it's not present in public directory!")
 			}
 		}
 	}
 
-	hashes := []string{}
-	// Was any file pushed ?
-	for _, servedFile := range servedFiles {
-		hashes = append(hashes, files.Get(servedFile).Etag)
+	if !isPushRequest(request) && request.Method != http.MethodHead {
+		// Void cookie cache if the client does not use its cache!
+		if !hasValidators(request) {
+			cache.Insert(
+				response,
+				map[string]bool{},
+				[]string{},
+			)
+		} else {
+			cache.Insert(
+				response,
+				cachedFiles,
+				append(pushedEtags, requestedFile.Etag),
+			)
+		}
 	}
 
-	// Must always accepts cache!
-	//- If it exists on cache ( cookie ) or has a X-Push-304 header, push 304
-	if (hashExistsInCache(requestedFile.Etag, cachedFiles) ||
-		hasPush304Header(request)) &&
-		acceptsCache(request, path) {
-
-		response.Header().Add("date", time.Now().String())
-		response.Header().Add("Content-Type", requestedFile.MimeType)
-		response.Header().Add("Content-Length", fmt.Sprint(requestedFile.Size))
-
-		response.Header().Add("Cache-Control", "private, must-revalidate")
-		response.Header().Add("ETag", requestedFile.Etag)
-
-		response.WriteHeader(http.StatusNotModified)
-
+	if isNotModified(request, requestedFile) {
+		send304(response, requestedFile)
 		return
 	}
 
-	// Void cookie cache if server does not accepts cache!
-	if !acceptsCache(request, path) {
-		cache.Insert(
-			response,
-			map[string]bool{},
-			[]string{},
-		)
-	}
+	sendFile(response, request, requestedFile)
+}
 
-	// If it did not fall under 304 push requested file into server hashs!
-	hashes = append(hashes, requestedFile.Etag)
+// setValidators adds the headers used by the client to revalidate the file
+func setValidators(response http.ResponseWriter, file *files.File) {
+	response.Header().Set("ETag", file.EtagHeader())
+	response.Header().Set("Cache-Control", "private, must-revalidate")
 
-	// Only push cookies when something was served!
-	if !isPushRequest(request) && len(hashes) > 0 && acceptsCache(request, path) {
-		cache.Insert(
-			response,
-			cachedFiles,
-			hashes,
-		)
+	if !file.LastModified.IsZero() {
+		response.Header().Set("Last-Modified", file.LastModified.UTC().Format(http.TimeFormat))
 	}
-
-	response.Header().Add("Content-Type", requestedFile.MimeType)
-	response.Header().Add("Content-Length", fmt.Sprint(requestedFile.TrueSize()))
-	response.Header().Add("ETag", requestedFile.Etag)
-	response.Header().Add("Cache-Control", "private, must-revalidate")
-	response.Write(requestedFile.GetContent())
-
 }
 
-func sendFile(response http.ResponseWriter, file *files.File) {
+// sendFile sends the file, HEAD requests only receive its headers
+func sendFile(response http.ResponseWriter, request *http.Request, file *files.File) {
+	content := file.GetContent()
 
-}
+	setValidators(response, file)
+	response.Header().Set("Content-Type", file.MimeType)
+	response.Header().Set("Content-Length", fmt.Sprint(len(content)))
 
-func send304(response http.ResponseWriter, file *files.File) {
+	if len(file.SourceMap) > 0 {
+		response.Header().Set("SourceMap", file.PublicPath+pathresolver.SourceMapSuffix)
+	}
 
-}
+	if request.Method == http.MethodHead {
+		response.WriteHeader(http.StatusOK)
+		return
+	}
 
-func hasPush304Header(request *http.Request) bool {
-	return len(request.Header["X-Push-304"]) > 0
+	response.Write(content)
 }
 
-func acceptsCache(request *http.Request, file string) bool {
-	var checkEtag = ""
-
-	if len(request.Header["If-None-Match"]) > 0 {
-		checkEtag = request.Header["If-None-Match"][0]
-	}
-
-	return files.Get(file).Etag == checkEtag && checkEtag != ""
+// send304 answers a conditional request whose cached response is still valid
+func send304(response http.ResponseWriter, file *files.File) {
+	setValidators(response, file)
+	response.WriteHeader(http.StatusNotModified)
 }
 
 func isPushRequest(request *http.Request) bool {
@@ -226,15 +211,28 @@ func FlattenDependencies(
 
 		for _, pathDep := range file.Dependencies {
 
+			// Already flattened ?
+			if previousDependencies[pathDep] {
+				continue
+			}
+
+			// Dependencies are the urls requested by the browser, which
+			// may differ from the file serving them (util.js -> util.ts)
+			truePath, err := pathresolver.Resolve(pathDep, PublicRoot)
+			if err != nil {
+				continue
+			}
+			depFile := files.Get(truePath)
+
 			// Extrapolate max size?
-			if *sizeAmount+file.TrueSize() > MaxPushSizeInBytes {
+			if *sizeAmount+depFile.TrueSize() > MaxPushSizeInBytes {
 				break
 			}
 
-			*sizeAmount += file.TrueSize()
+			*sizeAmount += depFile.TrueSize()
 			previousDependencies[pathDep] = true
 
-			FlattenDependencies(files.Get(pathDep), depth+1, previousDependencies, sizeAmount)
+			FlattenDependencies(depFile, depth+1, previousDependencies, sizeAmount)
 		}
 	}
 
@@ -251,7 +249,18 @@ func FlattenDependencies(
 // "X-No-Further-Pushs"
 func pushFile(push http.Pusher, file *files.File, requestedURL string, cachedFiles map[string]bool) {
 
-	removePubRoot := requestedURL[len(PublicRoot):]
+	// The client already has the file, pushing it again only wastes
+	// bandwidth
+	if hashExistsInCache(file.Etag, cachedFiles) {
+		return
+	}
+
+	// Push the url the browser will request, not the path of the file
+	// serving it
+	removePubRoot := file.PublicPath
+	if strings.HasPrefix(requestedURL, PublicRoot) {
+		removePubRoot = requestedURL[len(PublicRoot):]
+	}
 
 	opts := http.PushOptions{
 		Header: map[string][]string{
@@ -263,10 +272,6 @@ func pushFile(push http.Pusher, file *files.File, requestedURL string, cachedFil
 		Method: "GET",
 	}
 
-	if hashExistsInCache(file.Etag, cachedFiles) {
-		opts.Header["X-Push-304"] = []string{"true"}
-	}
-
 	err := push.Push(strings.ReplaceAll(removePubRoot, "\\", "/"), &opts)
 	if err != nil {
 		pretty.Println("Failed to push file", removePubRoot, err)
@@ -0,0 +1,135 @@
+// Package cssmodules scopes the class names of "*.module.css" files, every
+// class gets a suffix derived from the file path so modules never clash.
+// Imported from javascript a css module injects its style and exports the
+// mapping from the original class names to the scoped ones
+package cssmodules
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nonanick/impatience/files"
+	"github.com/nonanick/impatience/options"
+	"github.com/nonanick/impatience/transform"
+	"github.com/nonanick/impatience/transform/imports"
+	"github.com/nonanick/impatience/transform/jsscan"
+)
+
+// Name of the transformer in pipelines
+const Name = "css-modules"
+
+// Suffix files ending with it are css modules
+const Suffix = ".module.css"
+
+// ScopedName name a class of the css module at path is renamed to
+var ScopedName = func(className string, path string) string {
+	return className + "_" + Hash(path)
+}
+
+// classNames mapping of each transformed css module
+var classNames = map[string]map[string]string{}
+var classNamesLock sync.RWMutex
+
+// Register adds the css modules transformer and the proxy exporting their
+// class names
+func Register() {
+	transform.AddTransformer(transform.Transformer{
+		Name:       Name,
+		Extensions: []string{".css"},
+		Priority:   transform.PriorityTranspile,
+		Transform:  transform.Plain(Transform),
+	})
+	imports.AddProxy(imports.VariantImport, Suffix, ModuleProxy)
+}
+
+// IsModule the file is a css module
+func IsModule(path string) bool {
+	return strings.HasSuffix(path, Suffix)
+}
+
+// Hash stable hash of a file path, taken relative to the public root so it
+// does not change with the project location
+func Hash(path string) string {
+	relative, err := filepath.Rel(options.PublicRoot, path)
+	if err != nil {
+		relative = path
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(filepath.ToSlash(relative)))
+	return strconv.FormatUint(uint64(hash.Sum32()), 36)
+}
+
+// Transform scopes the class names of css modules, other css files are
+// left untouched
+func Transform(path string, content []byte) []byte {
+	if !IsModule(path) {
+		return content
+	}
+
+	scoped, mapping := Scope(content, func(className string) string {
+		return ScopedName(className, path)
+	})
+
+	classNamesLock.Lock()
+	classNames[path] = mapping
+	classNamesLock.Unlock()
+
+	return scoped
+}
+
+// ClassNames mapping of the class names of a transformed css module
+func ClassNames(path string) map[string]string {
+	classNamesLock.RLock()
+	defer classNamesLock.RUnlock()
+
+	mapping := map[string]string{}
+	for className, scopedName := range classNames[path] {
+		mapping[className] = scopedName
+	}
+	return mapping
+}
+
+// ModuleProxy module injecting the style of a css module and exporting its
+// class names, as the default export and as named exports when the class
+// name is a valid identifier
+var ModuleProxy imports.Proxy = func(source *files.File) []byte {
+	mapping := ClassNames(source.Path)
+
+	encoded, err := json.Marshal(mapping)
+	if err != nil {
+		encoded = []byte("{}")
+	}
+
+	names := []string{}
+	for className := range mapping {
+		names = append(names, className)
+	}
+	sort.Strings(names)
+
+	module := imports.InjectStyle(source) +
+		"var classes = " + string(encoded) + ";\n" +
+		"export default classes;\n"
+
+	exported := []string{}
+	for _, className := range names {
+		if !jsscan.IsIdentifier(className) {
+			continue
+		}
+
+		local := "__class_" + strconv.Itoa(len(exported))
+		module += "var " + local + " = classes[" + jsscan.Quote(className) + "];\n"
+		exported = append(exported, local+" as "+className)
+	}
+
+	if len(exported) > 0 {
+		module += "export { " + strings.Join(exported, ", ") + " };\n"
+	}
+
+	return []byte(module)
+}
@@ -0,0 +1,233 @@
+package cssmodules
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Scope renames the class selectors of a stylesheet, declarations and
+// at-rule preludes are copied as they are. Classes inside ":global(...)" keep
+// their name and ":local(...)" is the default. Return the scoped stylesheet
+// and the mapping between the original and the new class names
+func Scope(content []byte, rename func(className string) string) ([]byte, map[string]string) {
+	mapping := map[string]string{}
+
+	var scoped bytes.Buffer
+	preludeStart := 0
+
+	for index := 0; index < len(content); index++ {
+		switch content[index] {
+		case '/':
+			index = commentEnd(content, index) - 1
+		case '"', '\'':
+			index = stringEnd(content, index) - 1
+		case ';', '}':
+			scoped.Write(content[preludeStart : index+1])
+			preludeStart = index + 1
+		case '{':
+			prelude := content[preludeStart:index]
+			if !strings.HasPrefix(strings.TrimSpace(string(prelude)), "@") {
+				prelude = scopeSelector(prelude, rename, mapping)
+			}
+			scoped.Write(prelude)
+			scoped.WriteByte('{')
+			preludeStart = index + 1
+		}
+	}
+	scoped.Write(content[preludeStart:])
+
+	return scoped.Bytes(), mapping
+}
+
+// scopeSelector renames the classes of a selector list
+func scopeSelector(selector []byte, rename func(string) string, mapping map[string]string) []byte {
+	var scoped bytes.Buffer
+
+	for index := 0; index < len(selector); index++ {
+		char := selector[index]
+
+		switch {
+		case char == '/':
+			end := commentEnd(selector, index)
+			scoped.Write(selector[index:end])
+			index = end - 1
+
+		case char == '"' || char == '\'':
+			end := stringEnd(selector, index)
+			scoped.Write(selector[index:end])
+			index = end - 1
+
+		case char == '[':
+			end := attributeEnd(selector, index)
+			scoped.Write(selector[index:end])
+			index = end - 1
+
+		case hasPseudo(selector, index, ":global("):
+			start := index + len(":global(")
+			end := parenthesisEnd(selector, start)
+			scoped.Write(selector[start:end])
+			index = end
+
+		case hasPseudo(selector, index, ":local("):
+			start := index + len(":local(")
+			end := parenthesisEnd(selector, start)
+			scoped.Write(scopeSelector(selector[start:end], rename, mapping))
+			index = end
+
+		case char == '.' && isNameStart(selector, index+1):
+			end := nameEnd(selector, index+1)
+			className := unescape(string(selector[index+1 : end]))
+
+			scopedName, known := mapping[className]
+			if !known {
+				scopedName = rename(className)
+				mapping[className] = scopedName
+			}
+
+			scoped.WriteByte('.')
+			scoped.WriteString(escape(scopedName))
+			index = end - 1
+
+		default:
+			scoped.WriteByte(char)
+		}
+	}
+
+	return scoped.Bytes()
+}
+
+// commentEnd index right after the comment starting at index, a "/" that
+// does not open a comment is a single character
+func commentEnd(content []byte, index int) int {
+	if index+1 >= len(content) || content[index+1] != '*' {
+		return index + 1
+	}
+
+	end := bytes.Index(content[index+2:], []byte("*/"))
+	if end < 0 {
+		return len(content)
+	}
+	return index + 2 + end + 2
+}
+
+// stringEnd index right after the string starting at index
+func stringEnd(content []byte, index int) int {
+	quote := content[index]
+
+	for position := index + 1; position < len(content); position++ {
+		switch content[position] {
+		case '\\':
+			position++
+		case quote, '\n':
+			return position + 1
+		}
+	}
+	return len(content)
+}
+
+// attributeEnd index right after the attribute selector starting at index
+func attributeEnd(selector []byte, index int) int {
+	for position := index + 1; position < len(selector); position++ {
+		switch selector[position] {
+		case '"', '\'':
+			position = stringEnd(selector, position) - 1
+		case ']':
+			return position + 1
+		}
+	}
+	return len(selector)
+}
+
+// parenthesisEnd index of the parenthesis closing the one opened right
+// before start
+func parenthesisEnd(selector []byte, start int) int {
+	depth := 1
+
+	for position := start; position < len(selector); position++ {
+		switch selector[position] {
+		case '"', '\'':
+			position = stringEnd(selector, position) - 1
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return position
+			}
+		}
+	}
+	return len(selector)
+}
+
+func hasPseudo(selector []byte, index int, pseudo string) bool {
+	end := index + len(pseudo)
+	return end <= len(selector) && strings.EqualFold(string(selector[index:end]), pseudo)
+}
+
+// isNameStart a css identifier starts at index, "-" must be followed by
+// another name character so ".5em" or ".-1" are not classes
+func isNameStart(selector []byte, index int) bool {
+	if index >= len(selector) {
+		return false
+	}
+
+	char := selector[index]
+	if char == '-' {
+		return index+1 < len(selector) &&
+			(isNameCharacter(selector[index+1]) && !isDigit(selector[index+1]) || selector[index+1] == '\\')
+	}
+
+	return char == '\\' || char == '_' || char >= 0x80 ||
+		(char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+}
+
+// nameEnd index right after the css identifier starting at index
+func nameEnd(selector []byte, index int) int {
+	for index < len(selector) {
+		if selector[index] == '\\' && index+1 < len(selector) {
+			index += 2
+			continue
+		}
+		if !isNameCharacter(selector[index]) {
+			break
+		}
+		index++
+	}
+	return index
+}
+
+func isNameCharacter(char byte) bool {
+	return char == '-' || char == '_' || char >= 0x80 || isDigit(char) ||
+		(char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+}
+
+func isDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+// unescape removes the backslashes of a css identifier, ".sm\:flex" is the
+// class "sm:flex"
+func unescape(name string) string {
+	var unescaped strings.Builder
+
+	for index := 0; index < len(name); index++ {
+		if name[index] == '\\' && index+1 < len(name) {
+			index++
+		}
+		unescaped.WriteByte(name[index])
+	}
+	return unescaped.String()
+}
+
+// escape adds the backslashes a class name needs inside a selector
+func escape(name string) string {
+	var escaped strings.Builder
+
+	for index := 0; index < len(name); index++ {
+		if !isNameCharacter(name[index]) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteByte(name[index])
+	}
+	return escaped.String()
+}
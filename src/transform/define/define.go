@@ -0,0 +1,310 @@
+package define
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nonanick/impatience/files"
+	"github.com/nonanick/impatience/options"
+	"github.com/nonanick/impatience/transform"
+	"github.com/nonanick/impatience/transform/jsscan"
+	"github.com/nonanick/impatience/watcher"
+)
+
+// Extensions javascript outputs the replacements are applied to, transpiled
+// extensions are replaced after being transpiled
+var Extensions = []string{".js", ".mjs", ".cjs", ".jsx", ".ts", ".tsx"}
+
+// replacements every replaced key and the expression replacing it
+var replacements = map[string]string{}
+
+// affectedFiles files referencing the environment or a replaced key
+var affectedFiles = map[string]bool{}
+
+// Name of the transformer in pipelines
+const Name = "define"
+
+var lock sync.RWMutex
+
+// Register loads the replacements, watches the .env files and adds the
+// define transformer to the javascript outputs
+func Register() {
+	Reload()
+
+	for _, envFile := range options.EnvFiles {
+		watcher.WatchFile(envFile, func() {
+			fmt.Println(".env file changed, replacing defined values again")
+			Reload()
+			files.Invalidate(func(file *files.File) bool {
+				return IsAffected(file.Path)
+			})
+		})
+	}
+
+	transform.AddTransformer(transform.Transformer{
+		Name:       Name,
+		Extensions: Extensions,
+		Priority:   transform.PriorityDefine,
+		Transform:  transform.Plain(Transform),
+	})
+}
+
+// Reload builds the replacements from options.Define and the variables of
+// the .env files and process environment starting with options.EnvPrefix,
+// exposed through "import.meta.env" and "process.env"
+func Reload() {
+	exposed := map[string]string{}
+
+	for name, value := range LoadEnvFiles(options.EnvFiles) {
+		if strings.HasPrefix(name, options.EnvPrefix) {
+			exposed[name] = value
+		}
+	}
+
+	// The process environment overrides the .env files
+	for _, variable := range os.Environ() {
+		separator := strings.Index(variable, "=")
+		if separator > 0 && strings.HasPrefix(variable[:separator], options.EnvPrefix) {
+			exposed[variable[:separator]] = variable[separator+1:]
+		}
+	}
+
+	loaded := map[string]string{}
+	for name, value := range exposed {
+		loaded["import.meta.env."+name] = jsscan.Quote(value)
+		loaded["process.env."+name] = jsscan.Quote(value)
+	}
+
+	envObject, _ := json.Marshal(exposed)
+	loaded["import.meta.env"] = "(" + string(envObject) + ")"
+
+	// Explicit definitions win over the environment
+	for key, value := range options.Define {
+		loaded[key] = value
+	}
+
+	lock.Lock()
+	replacements = loaded
+	lock.Unlock()
+}
+
+// Replacements copy of the current replacements
+func Replacements() map[string]string {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	current := map[string]string{}
+	for key, value := range replacements {
+		current[key] = value
+	}
+	return current
+}
+
+// IsAffected the last transformation of the file referenced the
+// environment or replaced a key
+func IsAffected(path string) bool {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	return affectedFiles[path]
+}
+
+// Transform replaces every defined key used as an expression, keys being
+// assigned, declared, used as object keys or naming bindings (parameters,
+// shorthand properties, import and export specifiers) are left untouched
+func Transform(path string, content []byte) []byte {
+	tokens := jsscan.Tokenize(content)
+	current := Replacements()
+
+	affected := false
+	newContent := []byte{}
+	lastIndex := 0
+
+	for index := 0; index < len(tokens); index++ {
+		token := tokens[index]
+		if token.Kind != jsscan.Identifier || isMemberAccess(tokens, index) {
+			continue
+		}
+
+		chain, end, value := longestKey(tokens, index, current)
+		if strings.HasPrefix(chain, "process.env") || strings.HasPrefix(chain, "import.meta.env") {
+			affected = true
+		}
+
+		if value == "" || !isExpression(tokens, index, end) {
+			continue
+		}
+
+		affected = true
+		newContent = append(newContent, content[lastIndex:token.Start]...)
+		newContent = append(newContent, []byte(value)...)
+		lastIndex = tokens[end].End
+		index = end
+	}
+
+	lock.Lock()
+	affectedFiles[path] = affected
+	lock.Unlock()
+
+	if lastIndex == 0 {
+		return content
+	}
+
+	return append(newContent, content[lastIndex:]...)
+}
+
+// longestKey follows the member chain starting at index and return it, the
+// index of the last token of the longest defined key and its value
+func longestKey(tokens []jsscan.Token, index int, current map[string]string) (string, int, string) {
+	chain := tokens[index].Text
+	end, value := index, current[chain]
+
+	for position := index; position+2 < len(tokens) &&
+		tokens[position+1].Is(".") && tokens[position+2].Kind == jsscan.Identifier; position += 2 {
+
+		chain += "." + tokens[position+2].Text
+		if defined, isDefined := current[chain]; isDefined {
+			end, value = position+2, defined
+		}
+	}
+
+	return chain, end, value
+}
+
+// isExpression the key between start and end is read, not assigned,
+// declared, used as an object key or naming a binding
+func isExpression(tokens []jsscan.Token, start int, end int) bool {
+	if start == end && isBinding(tokens, start) {
+		return false
+	}
+
+	if end+1 < len(tokens) {
+		next := tokens[end+1]
+		if isAssignment(next) || next.Is("=>") || next.Is("++") || next.Is("--") {
+			return false
+		}
+		if start == end && next.Is(":") && start > 0 &&
+			(tokens[start-1].Is("{") || tokens[start-1].Is(",")) {
+			return false
+		}
+	}
+
+	if start > 0 {
+		previous := tokens[start-1]
+		if previous.Is("var") || previous.Is("let") || previous.Is("const") ||
+			previous.Is("function") || previous.Is("class") || previous.Is("++") ||
+			previous.Is("--") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isBinding the identifier names a binding or a property instead of being
+// read: a shorthand property or destructured name, a parameter or an import
+// or export specifier
+func isBinding(tokens []jsscan.Token, index int) bool {
+	previous, next := jsscan.Token{}, jsscan.Token{}
+	if index > 0 {
+		previous = tokens[index-1]
+	}
+	if index+1 < len(tokens) {
+		next = tokens[index+1]
+	}
+
+	// import name from, import * as name, { name as other }, { other as name }
+	if previous.Is("import") || previous.Is("as") || next.Is("as") {
+		return true
+	}
+
+	open := enclosingBracket(tokens, index)
+	if open < 0 {
+		return false
+	}
+
+	switch {
+	case tokens[open].Is("{"):
+		// { name }, { a, name }: shorthand properties, destructured names
+		// and specifier lists
+		return (previous.Is("{") || previous.Is(",")) && (next.Is(",") || next.Is("}"))
+	case tokens[open].Is("("):
+		return (previous.Is("(") || previous.Is(",") || previous.Is("...")) &&
+			(next.Is(",") || next.Is(")")) && isParameterList(tokens, open)
+	}
+
+	return false
+}
+
+// enclosingBracket index of the bracket opening the nesting of the token,
+// -1 at the top level
+func enclosingBracket(tokens []jsscan.Token, index int) int {
+	for position := index - 1; position >= 0; position-- {
+		if tokens[position].Depth == tokens[index].Depth-1 &&
+			(tokens[position].Is("(") || tokens[position].Is("[") || tokens[position].Is("{")) {
+			return position
+		}
+	}
+	return -1
+}
+
+// isParameterList the parentheses opening at open hold parameters: they
+// are followed by an arrow, follow a function name or open a method or catch
+// clause followed by its body
+func isParameterList(tokens []jsscan.Token, open int) bool {
+	close := open + 1
+	for close < len(tokens) && !(tokens[close].Is(")") && tokens[close].Depth == tokens[open].Depth) {
+		close++
+	}
+	if close+1 >= len(tokens) || open == 0 {
+		return close+1 < len(tokens) && tokens[close+1].Is("=>")
+	}
+
+	after := tokens[close+1]
+	if after.Is("=>") {
+		return true
+	}
+
+	// function (, function name (, function* name (
+	position := open - 1
+	if tokens[position].Kind == jsscan.Identifier && !tokens[position].Is("function") && position > 0 {
+		position--
+	}
+	if tokens[position].Is("*") && position > 0 {
+		position--
+	}
+	if tokens[position].Is("function") {
+		return true
+	}
+
+	before := tokens[open-1]
+	if !after.Is("{") || before.Kind != jsscan.Identifier {
+		return false
+	}
+
+	switch before.Text {
+	case "if", "for", "while", "switch", "with":
+		return false
+	}
+	return true
+}
+
+// isAssignment "=" and compound assignments, comparisons end with "=" too
+func isAssignment(token jsscan.Token) bool {
+	if token.Kind != jsscan.Punctuator || !strings.HasSuffix(token.Text, "=") {
+		return false
+	}
+
+	switch token.Text {
+	case "==", "===", "!=", "!==", "<=", ">=":
+		return false
+	}
+	return true
+}
+
+func isMemberAccess(tokens []jsscan.Token, index int) bool {
+	return index > 0 && (tokens[index-1].Is(".") || tokens[index-1].Is("?."))
+}
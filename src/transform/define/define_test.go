@@ -0,0 +1,58 @@
+package define
+
+import (
+	"testing"
+
+	"github.com/nonanick/impatience/options"
+)
+
+func TestTransform(t *testing.T) {
+	options.Define = map[string]string{
+		"__DEV__":              "true",
+		"process.env.NODE_ENV": `"development"`,
+	}
+	options.EnvFiles = []string{}
+	options.EnvPrefix = "IMPATIENCE_DEFINE_TEST_"
+	Reload()
+
+	cases := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"expression", "if (__DEV__) log()", "if (true) log()"},
+		{"member chain", "const mode = process.env.NODE_ENV", `const mode = "development"`},
+		{"argument", "log(a, __DEV__, b)", "log(a, true, b)"},
+		{"property value", "const o = { dev: __DEV__ }", "const o = { dev: true }"},
+		{"default value", "function f(a = __DEV__) {}", "function f(a = true) {}"},
+		{"spread", "const o = { ...__DEV__ }", "const o = { ...true }"},
+		{"declaration", "const __DEV__ = false", "const __DEV__ = false"},
+		{"assignment", "__DEV__ = false", "__DEV__ = false"},
+		{"object key", "const o = { __DEV__: 1 }", "const o = { __DEV__: 1 }"},
+		{"member", "o.__DEV__", "o.__DEV__"},
+		{"shorthand", "const o = { __DEV__ }", "const o = { __DEV__ }"},
+		{"shorthand list", "const o = { a, __DEV__, b }", "const o = { a, __DEV__, b }"},
+		{"destructuring", "const { __DEV__ } = flags", "const { __DEV__ } = flags"},
+		{"parameter", "function f(__DEV__) {}", "function f(__DEV__) {}"},
+		{"named parameter list", "function f(a, __DEV__ = 1) {}", "function f(a, __DEV__ = 1) {}"},
+		{"arrow parameters", "const f = (a, __DEV__) => a", "const f = (a, __DEV__) => a"},
+		{"arrow parameter", "const f = __DEV__ => 1", "const f = __DEV__ => 1"},
+		{"method parameter", "class A { m(__DEV__) {} }", "class A { m(__DEV__) {} }"},
+		{"catch binding", "try {} catch (__DEV__) {}", "try {} catch (__DEV__) {}"},
+		{"import specifier", `import { __DEV__ as d } from "flags"`, `import { __DEV__ as d } from "flags"`},
+		{"import alias", `import { dev as __DEV__ } from "flags"`, `import { dev as __DEV__ } from "flags"`},
+		{"default import", `import __DEV__ from "flags"`, `import __DEV__ from "flags"`},
+		{"namespace import", `import * as __DEV__ from "flags"`, `import * as __DEV__ from "flags"`},
+		{"export specifier", "export { __DEV__ }", "export { __DEV__ }"},
+		{"condition", "while (__DEV__) {}", "while (true) {}"},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			output := string(Transform("test.js", []byte(test.content)))
+			if output != test.expected {
+				t.Errorf("got %s, want %s", output, test.expected)
+			}
+		})
+	}
+}
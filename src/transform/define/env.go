@@ -0,0 +1,79 @@
+package define
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// LoadEnvFiles reads the .env files in order, variables of later files
+// override the earlier ones. Missing files are ignored
+func LoadEnvFiles(paths []string) map[string]string {
+	env := map[string]string{}
+
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		for name, value := range ParseEnv(content) {
+			env[name] = value
+		}
+	}
+
+	return env
+}
+
+// ParseEnv parses the content of a .env file: "NAME=value" lines with an
+// optional "export " prefix, single or double quoted values and comments
+// starting with "#"
+func ParseEnv(content []byte) map[string]string {
+	env := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+
+		separator := strings.Index(line, "=")
+		if separator <= 0 {
+			continue
+		}
+
+		name := strings.TrimSpace(line[:separator])
+		env[name] = parseEnvValue(strings.TrimSpace(line[separator+1:]))
+	}
+
+	return env
+}
+
+func parseEnvValue(value string) string {
+	if len(value) >= 2 && value[0] == '"' {
+		if end := strings.LastIndex(value, "\""); end > 0 {
+			if unquoted, err := strconv.Unquote(value[:end+1]); err == nil {
+				return unquoted
+			}
+			return value[1:end]
+		}
+	}
+
+	if len(value) >= 2 && value[0] == '\'' {
+		if end := strings.LastIndex(value, "'"); end > 0 {
+			return value[1:end]
+		}
+	}
+
+	// Unquoted values end at an inline comment
+	if comment := strings.Index(value, " #"); comment >= 0 {
+		value = value[:comment]
+	}
+
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,254 @@
+// Package diskcache keeps the output of transformers on disk between
+// launches. Entries are evicted least recently used first once the cache
+// grows past options.TransformCacheSize
+package diskcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kr/pretty"
+	"github.com/nonanick/impatience/diagnostics"
+	"github.com/nonanick/impatience/options"
+)
+
+// Entry cached output of a transformer, with the diagnostics it reported
+type Entry struct {
+	Content     []byte
+	SourceMap   []byte
+	Diagnostics []diagnostics.Diagnostic
+}
+
+// entryInfo size and last use of a cached entry
+type entryInfo struct {
+	size int64
+	used time.Time
+}
+
+// index entries on disk, loaded on first use
+var index map[string]*entryInfo
+var totalSize int64
+var lock sync.Mutex
+
+// Dir folder holding the cache, options.TransformCacheDir is relative to the
+// node_modules root unless absolute
+func Dir() string {
+	if filepath.IsAbs(options.TransformCacheDir) {
+		return options.TransformCacheDir
+	}
+
+	return filepath.Join(nodeModulesRoot(), options.TransformCacheDir)
+}
+
+// nodeModulesRoot the node_modules root, relative to the public root unless
+// absolute
+func nodeModulesRoot() string {
+	if filepath.IsAbs(options.NodeModulesRoot) {
+		return options.NodeModulesRoot
+	}
+
+	return filepath.Join(options.PublicRoot, options.NodeModulesRoot)
+}
+
+// Enabled the cache is used, a cache folder holding the project files is
+// never used as entries are evicted from it
+func Enabled() bool {
+	return options.TransformCache && options.TransformCacheDir != "" && isOwnDir()
+}
+
+// isOwnDir the cache folder does not hold the public root nor the
+// node_modules root
+func isOwnDir() bool {
+	dir, err := filepath.Abs(Dir())
+	if err != nil {
+		return false
+	}
+
+	for _, root := range []string{options.PublicRoot, nodeModulesRoot()} {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			return false
+		}
+
+		relative, err := filepath.Rel(dir, root)
+		if err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Key hash identifying an entry, built from everything the output depends on
+func Key(parts ...[]byte) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		// The length keeps ("ab", "c") and ("a", "bc") apart
+		hash.Write([]byte{byte(len(part) >> 24), byte(len(part) >> 16), byte(len(part) >> 8), byte(len(part))})
+		hash.Write(part)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Get reads a cached entry, marking it as recently used
+func Get(key string) (Entry, bool) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	loadIndex()
+
+	info, cached := index[key]
+	if !cached {
+		return Entry{}, false
+	}
+
+	file := filepath.Join(Dir(), key)
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		forget(key)
+		return Entry{}, false
+	}
+
+	entry := Entry{}
+	if err := gob.NewDecoder(bytes.NewReader(content)).Decode(&entry); err != nil {
+		os.Remove(file)
+		forget(key)
+		return Entry{}, false
+	}
+
+	// The modification time keeps the order of use across launches
+	info.used = time.Now()
+	os.Chtimes(file, info.used, info.used)
+
+	return entry, true
+}
+
+// Put stores an entry, evicting the least recently used entries when the
+// cache gets too big
+func Put(key string, entry Entry) {
+	var encoded bytes.Buffer
+	if err := gob.NewEncoder(&encoded).Encode(entry); err != nil {
+		pretty.Println("Could not encode transform cache entry", err.Error())
+		return
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	loadIndex()
+
+	if err := os.MkdirAll(Dir(), 0755); err != nil {
+		pretty.Println("Could not create transform cache folder", Dir(), err.Error())
+		return
+	}
+
+	// Written aside then renamed so a crash never leaves half an entry
+	file := filepath.Join(Dir(), key)
+	temporary := file + ".tmp"
+	if err := ioutil.WriteFile(temporary, encoded.Bytes(), 0644); err != nil {
+		pretty.Println("Could not write transform cache entry", err.Error())
+		return
+	}
+	if err := os.Rename(temporary, file); err != nil {
+		os.Remove(temporary)
+		return
+	}
+
+	forget(key)
+	index[key] = &entryInfo{size: int64(encoded.Len()), used: time.Now()}
+	totalSize += int64(encoded.Len())
+
+	evict()
+}
+
+// Clean removes every cached entry, a cache folder holding the public root
+// or the node_modules root is left untouched
+func Clean() error {
+	if !isOwnDir() {
+		return errors.New("Refusing to remove " + Dir() + ", it holds the project files")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	index = nil
+	totalSize = 0
+
+	return os.RemoveAll(Dir())
+}
+
+// Size bytes used by the cache and the amount of entries
+func Size() (int64, int) {
+	lock.Lock()
+	defer lock.Unlock()
+
+	loadIndex()
+	return totalSize, len(index)
+}
+
+// loadIndex lists the entries on disk, must be called holding lock
+func loadIndex() {
+	if index != nil {
+		return
+	}
+
+	index = map[string]*entryInfo{}
+	totalSize = 0
+
+	entries, err := ioutil.ReadDir(Dir())
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) == ".tmp" {
+			continue
+		}
+
+		index[entry.Name()] = &entryInfo{size: entry.Size(), used: entry.ModTime()}
+		totalSize += entry.Size()
+	}
+}
+
+// forget removes an entry from the index, must be called holding lock
+func forget(key string) {
+	if info, indexed := index[key]; indexed {
+		totalSize -= info.size
+		delete(index, key)
+	}
+}
+
+// evict removes the least recently used entries until the cache fits
+// options.TransformCacheSize, must be called holding lock
+func evict() {
+	if options.TransformCacheSize <= 0 || totalSize <= options.TransformCacheSize {
+		return
+	}
+
+	keys := []string{}
+	for key := range index {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		return index[keys[a]].used.Before(index[keys[b]].used)
+	})
+
+	for _, key := range keys {
+		if totalSize <= options.TransformCacheSize {
+			return
+		}
+
+		os.Remove(filepath.Join(Dir(), key))
+		forget(key)
+	}
+}
@@ -0,0 +1,81 @@
+package imports
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nonanick/impatience/files"
+	"github.com/nonanick/impatience/options"
+	"github.com/nonanick/impatience/transform/jsscan"
+	"github.com/nonanick/impatience/transform/nodemodules"
+)
+
+// AssetProxy module exporting the public url of the source file, like
+// bundlers do for images, fonts and other assets
+var AssetProxy Proxy = func(source *files.File) []byte {
+	return []byte("export default " + jsscan.Quote(source.PublicPath) + ";\n")
+}
+
+// JSONProxy module exporting the parsed json as default, the top level keys
+// of an object that are valid identifiers are also named exports
+var JSONProxy Proxy = func(source *files.File) []byte {
+	content := source.GetContent()
+
+	var value interface{}
+	if err := json.Unmarshal(content, &value); err != nil {
+		return []byte("throw new SyntaxError(" +
+			jsscan.Quote("Invalid JSON in "+source.PublicPath+": "+err.Error()) + ");\n")
+	}
+
+	// JSON is a valid javascript expression, keeping it as it is preserves
+	// the order of the keys and the precision of the numbers
+	module := "var json = " + strings.TrimSpace(string(content)) + ";\nexport default json;\n"
+
+	object, isObject := value.(map[string]interface{})
+	if !isObject {
+		return []byte(module)
+	}
+
+	keys := []string{}
+	for key := range object {
+		if jsscan.IsIdentifier(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	exported := []string{}
+	for _, key := range keys {
+		local := "__json_" + strconv.Itoa(len(exported))
+		module += "var " + local + " = json[" + jsscan.Quote(key) + "];\n"
+		exported = append(exported, local+" as "+key)
+	}
+
+	if len(exported) > 0 {
+		module += "export { " + strings.Join(exported, ", ") + " };\n"
+	}
+
+	return []byte(module)
+}
+
+// importedFileExists the imported url is a file as it is, imports without
+// extension or of folders are resolved to javascript later on and must not
+// be proxied
+func importedFileExists(importer string, specifier string) bool {
+	file := filepath.Join(filepath.Dir(importer), filepath.FromSlash(specifier))
+
+	if strings.HasPrefix(specifier, "/") {
+		file = filepath.Join(options.PublicRoot, filepath.FromSlash(specifier))
+
+		if nodeFile, err := nodemodules.FileOf(specifier); err == nil {
+			file = nodeFile
+		}
+	}
+
+	info, err := os.Stat(file)
+	return err == nil && !info.IsDir()
+}
@@ -0,0 +1,81 @@
+package imports
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/nonanick/impatience/files"
+	"github.com/nonanick/impatience/transform/jsscan"
+)
+
+// StyleProxy module injecting the css of the source file into a <style>
+// tag, importing it again updates the same tag
+var StyleProxy Proxy = func(source *files.File) []byte {
+	return []byte(InjectStyle(source) + "export default css;\n")
+}
+
+// InjectStyle statements declaring "css" with the style of the source file
+// and injecting it into the <style> tag of the file
+func InjectStyle(source *files.File) string {
+	return `var css = ` + jsscan.Quote(StyleOf(source)) + `;
+(function (id) {
+	var style = Array.prototype.find.call(
+		document.querySelectorAll("style[data-impatience-css]"),
+		function (element) { return element.getAttribute("data-impatience-css") === id; }
+	);
+	if (!style) {
+		style = document.createElement("style");
+		style.setAttribute("data-impatience-css", id);
+		document.head.appendChild(style);
+	}
+	style.textContent = css;
+})(` + jsscan.Quote(source.PublicPath) + `);
+`
+}
+
+// StyleSheetProxy module exporting the css of the source file as a
+// constructable stylesheet, like css module scripts do
+var StyleSheetProxy Proxy = func(source *files.File) []byte {
+	return []byte(`var sheet = new CSSStyleSheet();
+sheet.replaceSync(` + jsscan.Quote(StyleOf(source)) + `);
+export default sheet;
+`)
+}
+
+var cssURLMatcher = regexp.MustCompile(`url\(\s*(['"]?)([^'")]+)(['"]?)\s*\)`)
+
+// cssImportMatcher "@import" given a string instead of url()
+var cssImportMatcher = regexp.MustCompile(`@import\s+(['"])([^'"]+)['"]`)
+
+// StyleOf css of the file with its relative urls made absolute, the css no
+// longer lives at its own url once injected into the document
+func StyleOf(source *files.File) string {
+	base := path.Dir(strings.SplitN(source.PublicPath, "?", 2)[0])
+
+	style := cssURLMatcher.ReplaceAllStringFunc(string(source.GetContent()), func(match string) string {
+		url := strings.TrimSpace(cssURLMatcher.FindStringSubmatch(match)[2])
+
+		if !isRelativeURL(url) {
+			return match
+		}
+
+		return "url(" + jsscan.Quote(path.Join(base, url)) + ")"
+	})
+
+	return cssImportMatcher.ReplaceAllStringFunc(style, func(match string) string {
+		url := strings.TrimSpace(cssImportMatcher.FindStringSubmatch(match)[2])
+
+		if !isRelativeURL(url) {
+			return match
+		}
+
+		return "@import " + jsscan.Quote(path.Join(base, url))
+	})
+}
+
+// isRelativeURL the url is resolved against the url of the stylesheet
+func isRelativeURL(url string) bool {
+	return !strings.HasPrefix(url, "/") && !strings.HasPrefix(url, "#") &&
+		!strings.Contains(url, ":")
+}
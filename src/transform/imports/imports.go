@@ -0,0 +1,216 @@
+// Package imports serves files imported from javascript that are not
+// javascript (css, json, assets) through generated proxy modules. Imports of
+// those files get a "?variant" query naming the proxy that serves them, the
+// url without the query keeps serving the original file
+package imports
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+
+	"github.com/nonanick/impatience/files"
+	"github.com/nonanick/impatience/transform"
+	"github.com/nonanick/impatience/transform/jsscan"
+)
+
+// Name of the transformer in pipelines
+const Name = "imports"
+
+// Proxy generates the javascript module standing for the source file
+type Proxy = files.Generator
+
+// Proxy variants, see AddProxy
+const (
+	// VariantImport default variant of imported files
+	VariantImport = "import"
+	// VariantSheet css imported "with { type: 'css' }"
+	VariantSheet = "sheet"
+)
+
+// AnyExtension proxies added for AnyExtension serve every extension without
+// its own proxy
+const AnyExtension = "*"
+
+// Extensions javascript outputs whose imports are rewritten
+var Extensions = []string{".js", ".mjs", ".cjs", ".jsx", ".ts", ".tsx"}
+
+// attributeVariants variant used for each "type" import attribute
+var attributeVariants = map[string]string{
+	"css":  VariantSheet,
+	"json": VariantImport,
+}
+
+// registeredProxies proxies by variant and extension
+var registeredProxies = map[string]map[string]Proxy{}
+
+// Register adds the css, json and asset proxies and the transformer
+// rewriting imports of proxied files
+func Register() {
+	AddProxy(VariantImport, ".css", StyleProxy)
+	AddProxy(VariantSheet, ".css", StyleSheetProxy)
+	AddProxy(VariantImport, ".json", JSONProxy)
+	AddProxy(VariantImport, AnyExtension, AssetProxy)
+
+	transform.AddTransformer(transform.Transformer{
+		Name:       Name,
+		Extensions: Extensions,
+		Priority:   transform.PriorityImports,
+		Transform:  transform.Plain(Transform),
+	})
+}
+
+// AddProxy adds the proxy generating the module of a variant for an
+// extension
+func AddProxy(variant string, extension string, proxy Proxy) {
+	if registeredProxies[variant] == nil {
+		registeredProxies[variant] = map[string]Proxy{}
+	}
+	registeredProxies[variant][extension] = proxy
+}
+
+// AddAttributeVariant uses a variant for imports declaring the "type"
+// import attribute
+func AddAttributeVariant(attributeType string, variant string) {
+	attributeVariants[attributeType] = variant
+}
+
+// IsVariant a proxy variant with that name exists
+func IsVariant(variant string) bool {
+	return len(registeredProxies[variant]) > 0
+}
+
+// proxyFor the proxy of a variant serving the file, the longest registered
+// extension ending the path wins so ".module.css" can have its own proxy
+func proxyFor(variant string, path string) Proxy {
+	extension := ""
+	for registered := range registeredProxies[variant] {
+		if registered != AnyExtension && strings.HasSuffix(path, registered) &&
+			len(registered) > len(extension) {
+			extension = registered
+		}
+	}
+
+	if extension != "" {
+		return registeredProxies[variant][extension]
+	}
+
+	// Javascript is imported as it is
+	mimeType := transform.OutputOf(filepath.Ext(path)).MimeType
+	if strings.HasPrefix(mimeType, "text/javascript") || isJavascript(path) {
+		return nil
+	}
+
+	return registeredProxies[variant][AnyExtension]
+}
+
+// Generate adds the proxy module of a variant for a known file and return
+// its path, the file path followed by "?variant"
+func Generate(path string, variant string) (string, error) {
+	generated := path + "?" + variant
+	if files.IsKnown(generated) {
+		return generated, nil
+	}
+
+	proxy := proxyFor(variant, path)
+	if proxy == nil {
+		return "", errors.New("No " + variant + " proxy can serve " + path)
+	}
+
+	source := files.Get(path)
+	_, err := files.AddGenerated(
+		generated,
+		path,
+		source.PublicPath+"?"+variant,
+		"text/javascript",
+		true,
+		proxy,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return generated, nil
+}
+
+// Transform adds the proxy variant to imports of proxied files, an import
+// declaring a "type" attribute uses the variant of that type and the
+// attribute is removed since the proxy is javascript
+func Transform(path string, content []byte) []byte {
+	tokens := jsscan.Tokenize(content)
+
+	newContent := []byte{}
+	lastIndex := 0
+
+	for _, specifier := range jsscan.ModuleSpecifiers(tokens) {
+		if strings.Contains(specifier.Value, "?") || !isURL(specifier.Value) {
+			continue
+		}
+
+		variant := VariantImport
+		attributeType, attributesEnd := importAttributes(tokens, specifier.Index)
+		if attributeType != "" {
+			if attributeVariant, known := attributeVariants[attributeType]; known {
+				variant = attributeVariant
+			}
+		}
+
+		if proxyFor(variant, specifier.Value) == nil ||
+			!importedFileExists(path, specifier.Value) {
+			continue
+		}
+
+		newContent = append(newContent, content[lastIndex:specifier.Token.Start]...)
+		newContent = append(newContent, []byte(jsscan.Quote(specifier.Value+"?"+variant))...)
+		lastIndex = specifier.Token.End
+
+		if attributesEnd > 0 {
+			lastIndex = tokens[attributesEnd].End
+		}
+	}
+
+	if lastIndex == 0 {
+		return content
+	}
+
+	return append(newContent, content[lastIndex:]...)
+}
+
+// importAttributes reads the 'with { type: "x" }' clause following a static
+// specifier, return the type and the index of the closing brace
+func importAttributes(tokens []jsscan.Token, index int) (string, int) {
+	if index+2 >= len(tokens) ||
+		!(tokens[index+1].Is("with") || tokens[index+1].Is("assert")) ||
+		!tokens[index+2].Is("{") {
+		return "", 0
+	}
+
+	attributeType := ""
+	for position := index + 3; position < len(tokens); position++ {
+		if tokens[position].Is("}") {
+			return attributeType, position
+		}
+
+		if (tokens[position].Is("type") || tokens[position].Text == "\"type\"") &&
+			position+2 < len(tokens) && tokens[position+1].Is(":") {
+			attributeType, _ = tokens[position+2].Value()
+		}
+	}
+
+	return "", 0
+}
+
+// isJavascript the path has one of the javascript Extensions
+func isJavascript(path string) bool {
+	for _, extension := range Extensions {
+		if filepath.Ext(path) == extension {
+			return true
+		}
+	}
+	return false
+}
+
+// isURL relative or absolute urls, bare specifiers are left to node modules
+func isURL(specifier string) bool {
+	return strings.HasPrefix(specifier, ".") || strings.HasPrefix(specifier, "/")
+}
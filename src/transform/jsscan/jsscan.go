@@ -0,0 +1,437 @@
+// Package jsscan splits javascript code into tokens, it is not a parser but
+// knows enough of the syntax (strings, templates, comments, regular
+// expressions) for transformers to rewrite code without touching the
+// content of strings and comments
+package jsscan
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Kind of a token
+type Kind int
+
+// Token kinds
+const (
+	Identifier Kind = iota
+	String
+	Template
+	Number
+	Regex
+	Punctuator
+)
+
+// Token a piece of javascript code, comments and whitespace are skipped
+type Token struct {
+	Kind  Kind
+	Text  string
+	Start int
+	End   int
+	// Depth nesting of (), [] and {} where the token starts, closing
+	// punctuators have the depth of their opening one
+	Depth int
+	// NewlineBefore a line break separates the token from the previous one,
+	// relevant for automatic semicolon insertion
+	NewlineBefore bool
+}
+
+// Is check if the token is the given identifier or punctuator
+func (t Token) Is(text string) bool {
+	return (t.Kind == Identifier || t.Kind == Punctuator) && t.Text == text
+}
+
+// Value return the value of a string token without the quotes, false when
+// the token is not a string or a template without substitutions
+func (t Token) Value() (string, bool) {
+	switch t.Kind {
+	case String:
+		return unescape(t.Text[1 : len(t.Text)-1])
+	case Template:
+		if strings.Contains(t.Text, "${") {
+			return "", false
+		}
+		return unescape(t.Text[1 : len(t.Text)-1])
+	}
+
+	return "", false
+}
+
+// unescape resolves the escape sequences of a string literal body
+func unescape(body string) (string, bool) {
+	if !strings.Contains(body, "\\") {
+		return body, true
+	}
+
+	var value strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] != '\\' {
+			value.WriteByte(body[i])
+			continue
+		}
+
+		i++
+		if i >= len(body) {
+			return "", false
+		}
+
+		switch body[i] {
+		case 'n':
+			value.WriteByte('\n')
+		case 't':
+			value.WriteByte('\t')
+		case 'r':
+			value.WriteByte('\r')
+		case 'b':
+			value.WriteByte('\b')
+		case 'f':
+			value.WriteByte('\f')
+		case 'v':
+			value.WriteByte('\v')
+		case '0':
+			value.WriteByte(0)
+		case '\n':
+			// line continuation
+		case 'x', 'u':
+			size := 2
+			if body[i] == 'u' {
+				size = 4
+			}
+			if i+size >= len(body) {
+				return "", false
+			}
+			code, err := strconv.ParseUint(body[i+1:i+1+size], 16, 32)
+			if err != nil {
+				return "", false
+			}
+			value.WriteRune(rune(code))
+			i += size
+		default:
+			value.WriteByte(body[i])
+		}
+	}
+
+	return value.String(), true
+}
+
+// keywordsBeforeExpression after these a "/" starts a regular expression
+var keywordsBeforeExpression = map[string]bool{
+	"return": true, "typeof": true, "instanceof": true, "in": true,
+	"of": true, "new": true, "delete": true, "void": true, "throw": true,
+	"case": true, "do": true, "else": true, "yield": true, "await": true,
+}
+
+// punctuators sorted from the longest to the shortest
+var punctuators = []string{
+	">>>=", "...", "===", "!==", "**=", "<<=", ">>=", ">>>", "&&=", "||=", "??=",
+	"=>", "==", "!=", "<=", ">=", "&&", "||", "??", "?.", "++", "--",
+	"+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "**", "<<", ">>",
+	"{", "}", "(", ")", "[", "]", ";", ",", "<", ">", "+", "-", "*", "/",
+	"%", "&", "|", "^", "!", "~", "?", ":", "=", ".", "@", "#",
+}
+
+// Tokenize splits the code into tokens
+func Tokenize(content []byte) []Token {
+	code := string(content)
+	tokens := []Token{}
+	depth := 0
+	newline := false
+
+	for i := 0; i < len(code); {
+		char := code[i]
+
+		// Whitespace
+		if char == '\n' || char == '\r' {
+			newline = true
+			i++
+			continue
+		}
+		if char == ' ' || char == '\t' || char == '\f' || char == '\v' {
+			i++
+			continue
+		}
+
+		// Comments
+		if strings.HasPrefix(code[i:], "//") {
+			end := strings.IndexByte(code[i:], '\n')
+			if end < 0 {
+				break
+			}
+			i += end
+			continue
+		}
+		if strings.HasPrefix(code[i:], "/*") {
+			end := strings.Index(code[i+2:], "*/")
+			if end < 0 {
+				break
+			}
+			if strings.ContainsAny(code[i:i+2+end], "\n\r") {
+				newline = true
+			}
+			i += end + 4
+			continue
+		}
+
+		start := i
+		var kind Kind
+
+		switch {
+		case char == '"' || char == '\'':
+			kind = String
+			i = skipString(code, i)
+		case char == '`':
+			kind = Template
+			i = skipTemplate(code, i)
+		case char == '/' && regexAllowed(tokens):
+			kind = Regex
+			i = skipRegex(code, i)
+		case isDigit(char) || (char == '.' && i+1 < len(code) && isDigit(code[i+1])):
+			kind = Number
+			i++
+			for i < len(code) && (isIdentifierPart(code[i]) || code[i] == '.' ||
+				((code[i] == '+' || code[i] == '-') && (code[i-1] == 'e' || code[i-1] == 'E'))) {
+				i++
+			}
+		case isIdentifierStart(char):
+			kind = Identifier
+			i++
+			for i < len(code) && isIdentifierPart(code[i]) {
+				i++
+			}
+		default:
+			kind = Punctuator
+			matched := string(char)
+			for _, punctuator := range punctuators {
+				if strings.HasPrefix(code[i:], punctuator) {
+					matched = punctuator
+					break
+				}
+			}
+			i += len(matched)
+		}
+
+		token := Token{
+			Kind:          kind,
+			Text:          code[start:i],
+			Start:         start,
+			End:           i,
+			Depth:         depth,
+			NewlineBefore: newline,
+		}
+		newline = false
+
+		if kind == Punctuator {
+			switch token.Text {
+			case "(", "[", "{":
+				depth++
+			case ")", "]", "}":
+				if depth > 0 {
+					depth--
+				}
+				token.Depth = depth
+			}
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens
+}
+
+// regexAllowed check if a "/" after the tokens starts a regular expression
+// instead of being a division
+func regexAllowed(tokens []Token) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+
+	previous := tokens[len(tokens)-1]
+	switch previous.Kind {
+	case Identifier:
+		return keywordsBeforeExpression[previous.Text]
+	case Punctuator:
+		return previous.Text != ")" && previous.Text != "]" &&
+			previous.Text != "++" && previous.Text != "--"
+	}
+
+	return false
+}
+
+func skipString(code string, i int) int {
+	quote := code[i]
+	i++
+	for i < len(code) && code[i] != quote && code[i] != '\n' {
+		if code[i] == '\\' {
+			i++
+		}
+		i++
+	}
+	return min(i+1, len(code))
+}
+
+// skipTemplate skips a template literal including its substitutions
+func skipTemplate(code string, i int) int {
+	i++
+	for i < len(code) {
+		switch {
+		case code[i] == '\\':
+			i += 2
+		case code[i] == '`':
+			return i + 1
+		case strings.HasPrefix(code[i:], "${"):
+			i = skipSubstitution(code, i+2)
+		default:
+			i++
+		}
+	}
+	return len(code)
+}
+
+// skipSubstitution skips the code of a template substitution up to its
+// closing brace
+func skipSubstitution(code string, i int) int {
+	braces := 1
+	for _, token := range Tokenize([]byte(code[i:])) {
+		if token.Is("{") {
+			braces++
+		}
+		if token.Is("}") {
+			braces--
+			if braces == 0 {
+				return i + token.End
+			}
+		}
+	}
+	return len(code)
+}
+
+func skipRegex(code string, i int) int {
+	i++
+	inClass := false
+	for i < len(code) && code[i] != '\n' {
+		switch code[i] {
+		case '\\':
+			i++
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '/':
+			if !inClass {
+				i++
+				for i < len(code) && isIdentifierPart(code[i]) {
+					i++
+				}
+				return i
+			}
+		}
+		i++
+	}
+	return min(i, len(code))
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func isDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+func isIdentifierStart(char byte) bool {
+	return char == '_' || char == '$' ||
+		(char >= 'a' && char <= 'z') ||
+		(char >= 'A' && char <= 'Z') ||
+		char >= 0x80
+}
+
+func isIdentifierPart(char byte) bool {
+	return isIdentifierStart(char) || isDigit(char)
+}
+
+// IsIdentifier check if the name is a valid identifier that is not a
+// reserved word
+func IsIdentifier(name string) bool {
+	if name == "" || !isIdentifierStart(name[0]) || reserved[name] {
+		return false
+	}
+
+	for i := 1; i < len(name); i++ {
+		if !isIdentifierPart(name[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+var reserved = map[string]bool{
+	"break": true, "case": true, "catch": true, "class": true, "const": true,
+	"continue": true, "debugger": true, "default": true, "delete": true,
+	"do": true, "else": true, "enum": true, "export": true, "extends": true,
+	"false": true, "finally": true, "for": true, "function": true, "if": true,
+	"import": true, "in": true, "instanceof": true, "new": true, "null": true,
+	"return": true, "super": true, "switch": true, "this": true, "throw": true,
+	"true": true, "try": true, "typeof": true, "var": true, "void": true,
+	"while": true, "with": true, "yield": true, "let": true, "static": true,
+	"implements": true, "interface": true, "package": true, "private": true,
+	"protected": true, "public": true, "await": true,
+}
+
+// Quote return the name as a double quoted javascript string
+func Quote(name string) string {
+	quoted, _ := json.Marshal(name)
+	return string(quoted)
+}
+
+// Specifier module specifier of an import or export
+type Specifier struct {
+	// Token string token holding the specifier, at Index in the tokens
+	Token Token
+	Index int
+	Value string
+	// Dynamic the specifier is loaded by an import() call
+	Dynamic bool
+}
+
+// ModuleSpecifiers finds the specifiers of static imports and exports, side
+// effect imports and dynamic imports using a string literal
+func ModuleSpecifiers(tokens []Token) []Specifier {
+	specifiers := []Specifier{}
+
+	for index, token := range tokens {
+		if token.Kind != String || index == 0 {
+			continue
+		}
+
+		previous := tokens[index-1]
+		isMember := index > 1 && (tokens[index-2].Is(".") || tokens[index-2].Is("?."))
+		dynamic := false
+
+		switch {
+		// import x from "y", export { x } from "y"
+		case previous.Is("from") && !isMember:
+		// import "y"
+		case previous.Is("import") && !isMember:
+		// import("y")
+		case previous.Is("(") && index > 1 && tokens[index-2].Is("import") &&
+			index+1 < len(tokens) && (tokens[index+1].Is(")") || tokens[index+1].Is(",")):
+			dynamic = true
+		default:
+			continue
+		}
+
+		value, isLiteral := token.Value()
+		if !isLiteral {
+			continue
+		}
+
+		specifiers = append(specifiers, Specifier{Token: token, Index: index, Value: value, Dynamic: dynamic})
+	}
+
+	return specifiers
+}
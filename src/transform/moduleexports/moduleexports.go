@@ -1,15 +1,346 @@
 package moduleexports
 
-import "github.com/nonanick/impatience/transform"
+import (
+	"strconv"
+	"strings"
+
+	"github.com/nonanick/impatience/diagnostics"
+	"github.com/nonanick/impatience/transform"
+	"github.com/nonanick/impatience/transform/jsscan"
+)
+
+// Name of the transformer in pipelines
+const Name = "cjs-interop"
 
 // Register Module Exports transformer
 func Register() {
-	transform.AddFileTransformer(".js", Transform)
+	transform.AddTransformer(transform.Transformer{
+		Name:       Name,
+		Extensions: []string{".js", ".cjs"},
+		Priority:   transform.PriorityModules,
+		Transform:  transform.Plain(Transform),
+	})
 }
 
-// Transform tries to modify all module.export syntax
-// to ES6 export
+// Resolves tells if a specifier required by importer resolves to a module,
+// replaced by the node modules transformer with its resolution
+var Resolves = func(specifier string, importer string) bool {
+	return true
+}
+
+// Transform wraps CommonJS modules so the browser can import them, the
+// module body runs inside a function receiving module, exports and require.
+// The wrapped module exports module.exports as default plus every named
+// export that can be found statically, require calls using a string literal
+// that Resolves are hoisted to imports. Requiring any other module throws,
+// which a try block around an optional dependency catches
 func Transform(path string, content []byte) []byte {
+	tokens := jsscan.Tokenize(content)
+
+	if !isCommonJS(tokens) {
+		return content
+	}
+
+	requires := staticRequires(path, tokens)
+	names := exportedNames(tokens)
+
+	var wrapped strings.Builder
+
+	requireMap := []string{}
+	for index, specifier := range requires {
+		namespace := "__cjs_require_" + strconv.Itoa(index)
+		wrapped.WriteString("import * as " + namespace + " from " + jsscan.Quote(specifier) + ";\n")
+		requireMap = append(requireMap, jsscan.Quote(specifier)+": "+namespace)
+	}
+
+	wrapped.WriteString("var __cjs_requires = {" + strings.Join(requireMap, ", ") + "};\n")
+	wrapped.WriteString("var __cjs_module = { exports: {} };\n")
+	wrapped.WriteString("(function (module, exports, require) {")
+	wrapped.Write(content)
+	wrapped.WriteString(`
+}).call(__cjs_module.exports, __cjs_module, __cjs_module.exports, function (specifier) {
+	var required = __cjs_requires[specifier];
+	if (!required) {
+		throw new Error("Cannot require(\"" + specifier + "\"), only modules required with a string literal that resolve are supported");
+	}
+	return "__cjsExports" in required ? required.__cjsExports : required;
+});
+var __cjs_exports = __cjs_module.exports;
+export { __cjs_exports as __cjsExports };
+export default __cjs_exports && __cjs_exports.__esModule && "default" in __cjs_exports ? __cjs_exports.default : __cjs_exports;
+`)
+
+	if len(names) > 0 {
+		declarations := []string{}
+		for _, name := range names {
+			declarations = append(declarations, name+" = __cjs_exports."+name)
+		}
+		wrapped.WriteString("export var " + strings.Join(declarations, ", ") + ";\n")
+	}
+
+	return []byte(wrapped.String())
+}
+
+// IsCommonJS check if the code exports using "module.exports" or "exports"
+// and has no ES module syntax
+func IsCommonJS(content []byte) bool {
+	return isCommonJS(jsscan.Tokenize(content))
+}
+
+func isCommonJS(tokens []jsscan.Token) bool {
+	usesExports := false
+
+	for index := range tokens {
+		if isModuleSyntax(tokens, index) {
+			return false
+		}
+
+		if isExportsReference(tokens, index) {
+			usesExports = true
+		}
+	}
+
+	return usesExports
+}
+
+// isModuleSyntax top level import/export statements or import.meta
+func isModuleSyntax(tokens []jsscan.Token, index int) bool {
+	token := tokens[index]
+
+	if isMemberAccess(tokens, index) {
+		return false
+	}
+
+	if token.Is("export") && token.Depth == 0 {
+		return true
+	}
+
+	if token.Is("import") && index+1 < len(tokens) {
+		next := tokens[index+1]
+		if next.Is(".") {
+			return index+2 < len(tokens) && tokens[index+2].Is("meta")
+		}
+		return token.Depth == 0 && !next.Is("(")
+	}
+
+	return false
+}
+
+// isExportsReference "module.exports" or "exports" being used
+func isExportsReference(tokens []jsscan.Token, index int) bool {
+	if isMemberAccess(tokens, index) || index+1 >= len(tokens) {
+		return false
+	}
+
+	token := tokens[index]
+	next := tokens[index+1]
+
+	if token.Is("module") {
+		return next.Is(".") && index+2 < len(tokens) && tokens[index+2].Is("exports")
+	}
+
+	if token.Is("exports") {
+		return next.Is(".") || next.Is("[") || next.Is("=")
+	}
+
+	return false
+}
+
+// isExportsObject the token starts a "module.exports" or "exports" reference
+func isExportsObject(tokens []jsscan.Token, index int) bool {
+	if isMemberAccess(tokens, index) {
+		return false
+	}
+
+	if tokens[index].Is("module") {
+		return index+2 < len(tokens) && tokens[index+1].Is(".") && tokens[index+2].Is("exports")
+	}
+
+	return tokens[index].Is("exports")
+}
+
+// isMemberAccess the token is a property being accessed ("a.exports")
+func isMemberAccess(tokens []jsscan.Token, index int) bool {
+	return index > 0 && (tokens[index-1].Is(".") || tokens[index-1].Is("?."))
+}
+
+// staticRequires return the specifiers of every require call using a string
+// literal that resolves, in order and without repetitions. Other require
+// calls can't be hoisted and are reported
+func staticRequires(path string, tokens []jsscan.Token) []string {
+	specifiers := []string{}
+	known := map[string]bool{}
+
+	for index := range tokens {
+		if !tokens[index].Is("require") || isMemberAccess(tokens, index) ||
+			index+1 >= len(tokens) || !tokens[index+1].Is("(") {
+			continue
+		}
+
+		// Declaring a function named require is not a call
+		if index > 0 && tokens[index-1].Is("function") {
+			continue
+		}
+
+		specifier, isLiteral := "", false
+		if index+3 < len(tokens) && tokens[index+3].Is(")") {
+			specifier, isLiteral = tokens[index+2].Value()
+		}
+
+		if !isLiteral {
+			diagnostics.Warnf(
+				"CommonJS Interop", path,
+				"require call at offset %d does not use a string literal, it will throw in the browser",
+				tokens[index].Start,
+			)
+			continue
+		}
+
+		if known[specifier] {
+			continue
+		}
+		known[specifier] = true
+
+		if !Resolves(specifier, path) {
+			diagnostics.Warnf(
+				"CommonJS Interop", path,
+				"require(%s) at offset %d could not be resolved, it will throw in the browser",
+				jsscan.Quote(specifier), tokens[index].Start,
+			)
+			continue
+		}
+
+		specifiers = append(specifiers, specifier)
+	}
+
+	return specifiers
+}
+
+// ExportedNames names a CommonJS module exports that can be found
+// statically, see exportedNames
+func ExportedNames(content []byte) []string {
+	return exportedNames(jsscan.Tokenize(content))
+}
+
+// ReexportedModules specifiers of the modules a CommonJS module replaces
+// its exports with, through "module.exports = require('x')"
+func ReexportedModules(content []byte) []string {
+	tokens := jsscan.Tokenize(content)
+	specifiers := []string{}
+
+	for index := range tokens {
+		if !tokens[index].Is("module") || !isExportsObject(tokens, index) || index+7 >= len(tokens) {
+			continue
+		}
+
+		after := index + 3
+		if tokens[after].Is("=") && tokens[after+1].Is("require") &&
+			tokens[after+2].Is("(") && tokens[after+4].Is(")") {
+			if specifier, isLiteral := tokens[after+3].Value(); isLiteral {
+				specifiers = append(specifiers, specifier)
+			}
+		}
+	}
+
+	return specifiers
+}
+
+// exportedNames finds the names exported through "exports.name =",
+// "module.exports.name =", "Object.defineProperty(exports, 'name'" and
+// "module.exports = { name }"
+func exportedNames(tokens []jsscan.Token) []string {
+	names := []string{}
+	known := map[string]bool{}
+
+	add := func(name string) {
+		if jsscan.IsIdentifier(name) && name != "__esModule" &&
+			!strings.HasPrefix(name, "__cjs") && !known[name] {
+			known[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for index := range tokens {
+		if !isExportsObject(tokens, index) {
+			continue
+		}
+
+		// Position right after "exports"/"module.exports"
+		after := index + 1
+		if tokens[index].Is("module") {
+			after = index + 3
+		}
+
+		// Object.defineProperty(exports, "name", ...)
+		if index >= 4 && tokens[index-1].Is("(") && tokens[index-2].Is("defineProperty") &&
+			tokens[index-3].Is(".") && tokens[index-4].Is("Object") &&
+			after+1 < len(tokens) && tokens[after].Is(",") {
+			if name, isLiteral := tokens[after+1].Value(); isLiteral {
+				add(name)
+			}
+			continue
+		}
+
+		if after+2 >= len(tokens) {
+			continue
+		}
+
+		switch {
+		// exports.name =
+		case tokens[after].Is(".") && tokens[after+1].Kind == jsscan.Identifier &&
+			tokens[after+2].Is("="):
+			add(tokens[after+1].Text)
+
+		// exports["name"] =
+		case tokens[after].Is("[") && after+3 < len(tokens) && tokens[after+2].Is("]") &&
+			tokens[after+3].Is("="):
+			if name, isLiteral := tokens[after+1].Value(); isLiteral {
+				add(name)
+			}
+
+		// module.exports = { ... }
+		case tokens[index].Is("module") && tokens[after].Is("=") && tokens[after+1].Is("{"):
+			for _, name := range objectKeys(tokens, after+1) {
+				add(name)
+			}
+		}
+	}
+
+	return names
+}
+
+// objectKeys return the keys of the object literal opened at index
+func objectKeys(tokens []jsscan.Token, open int) []string {
+	keys := []string{}
+	depth := tokens[open].Depth + 1
+
+	for index := open + 1; index < len(tokens); index++ {
+		token := tokens[index]
+
+		if token.Is("}") && token.Depth == tokens[open].Depth {
+			break
+		}
+
+		if token.Depth != depth || index+1 >= len(tokens) {
+			continue
+		}
+
+		previous := tokens[index-1]
+		if !previous.Is("{") && !previous.Is(",") {
+			continue
+		}
+
+		next := tokens[index+1]
+		if !next.Is(":") && !next.Is(",") && !next.Is("}") && !next.Is("(") {
+			continue
+		}
+
+		if token.Kind == jsscan.Identifier {
+			keys = append(keys, token.Text)
+		} else if name, isLiteral := token.Value(); isLiteral {
+			keys = append(keys, name)
+		}
+	}
 
-	return content
+	return keys
 }
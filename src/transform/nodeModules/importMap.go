@@ -0,0 +1,145 @@
+package nodemodules
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/nonanick/impatience/files"
+	"github.com/nonanick/impatience/options"
+)
+
+// Node modules modes, see options.NodeModulesMode
+const (
+	ModeRewrite   = "rewrite"
+	ModeImportMap = "importmap"
+)
+
+// ImportMap import map injected into html files, packages resolving a
+// specifier to another file than the project does get their own scope
+type ImportMap struct {
+	Imports map[string]string            `json:"imports"`
+	Scopes  map[string]map[string]string `json:"scopes,omitempty"`
+}
+
+// ImportMapRefreshDelay time waited after the import map changes before
+// html files are transformed again, new specifiers usually arrive in bursts
+var ImportMapRefreshDelay = 200 * time.Millisecond
+
+var importMap = ImportMap{
+	Imports: map[string]string{},
+	Scopes:  map[string]map[string]string{},
+}
+var importMapLock sync.Mutex
+var importMapRefresh *time.Timer
+
+// UsesImportMap bare specifiers are kept and mapped by the import map
+func UsesImportMap() bool {
+	return options.NodeModulesMode == ModeImportMap
+}
+
+// AddImport records the url a specifier resolves to for importer, project
+// files fill the top level imports and node_modules files the scope of their
+// package
+func AddImport(specifier string, importer string, url string) {
+	scope := ""
+	if IsNodeModuleFile(importer) {
+		if pkg, err := NearestPackageJSON(filepath.Dir(importer)); err == nil {
+			scope = PublicURL(pkg.Dir) + "/"
+		}
+	}
+
+	importMapLock.Lock()
+	defer importMapLock.Unlock()
+
+	imports := importMap.Imports
+	if scope != "" {
+		if importMap.Scopes[scope] == nil {
+			importMap.Scopes[scope] = map[string]string{}
+		}
+		imports = importMap.Scopes[scope]
+	}
+
+	if imports[specifier] == url {
+		return
+	}
+	imports[specifier] = url
+
+	scheduleImportMapRefresh()
+}
+
+// CurrentImportMap copy of the import map, scoped specifiers resolving to
+// the same url as the top level imports are left out
+func CurrentImportMap() ImportMap {
+	importMapLock.Lock()
+	defer importMapLock.Unlock()
+
+	current := ImportMap{
+		Imports: map[string]string{},
+		Scopes:  map[string]map[string]string{},
+	}
+
+	for specifier, url := range importMap.Imports {
+		current.Imports[specifier] = url
+	}
+
+	for scope, imports := range importMap.Scopes {
+		for specifier, url := range imports {
+			if importMap.Imports[specifier] == url {
+				continue
+			}
+			if current.Scopes[scope] == nil {
+				current.Scopes[scope] = map[string]string{}
+			}
+			current.Scopes[scope][specifier] = url
+		}
+	}
+
+	return current
+}
+
+// scheduleImportMapRefresh transforms html files again once the import map
+// stops changing, must be called holding importMapLock
+func scheduleImportMapRefresh() {
+	if importMapRefresh != nil {
+		importMapRefresh.Stop()
+	}
+
+	importMapRefresh = time.AfterFunc(ImportMapRefreshDelay, func() {
+		files.Invalidate(func(file *files.File) bool {
+			return file.Extension == ".html"
+		})
+	})
+}
+
+var headMatcher = regexp.MustCompile(`(?i)<head(\s[^>]*)?>`)
+var scriptMatcher = regexp.MustCompile("(?i)<script")
+
+// ImportMapTransform injects the import map into html files, right after
+// <head> or before the first script
+func ImportMapTransform(path string, content []byte) []byte {
+	encoded, err := json.MarshalIndent(CurrentImportMap(), "", "  ")
+	if err != nil {
+		return content
+	}
+
+	// json escapes "<" so the map can't close the script tag
+	tag := []byte("\n<script type=\"importmap\">\n" + string(encoded) + "\n</script>\n")
+
+	position := 0
+	if head := headMatcher.FindIndex(content); head != nil {
+		position = head[1]
+	} else if script := scriptMatcher.FindIndex(content); script != nil {
+		position = script[0]
+	}
+
+	var injected bytes.Buffer
+	injected.Write(content[:position])
+	injected.Write(tag)
+	injected.Write(content[position:])
+
+	return injected.Bytes()
+}
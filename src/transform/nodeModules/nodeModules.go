@@ -1,18 +1,19 @@
 package nodemodules
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"sync"
 
+	"github.com/nonanick/impatience/diagnostics"
 	"github.com/nonanick/impatience/files"
 	"github.com/nonanick/impatience/options"
 	"github.com/nonanick/impatience/transform"
+	"github.com/nonanick/impatience/transform/jsscan"
+	"github.com/nonanick/impatience/transform/moduleexports"
 	"github.com/nonanick/impatience/transform/require"
 )
 
@@ -24,156 +25,234 @@ var registeredNodeLibraries map[string]bool = map[string]bool{}
 
 var registeredDependencies map[string]bool = map[string]bool{}
 
-var knownLibs = map[string]bool{}
 var loadedFiles = map[string]bool{}
 
-// AddNodeFile exposes a file present in node_modules
-func AddNodeFile(file string) {
-
-	libName := file
-	targetFile := file
-
-	// If node file has "/" its targeting a file inside of a package, the lib
-	// name will be the first portion
-	if strings.Index(file, "/") > 0 {
-		libName = strings.Split(file, "/")[0]
-	} else
-	// If the file is targeting the root of the lib it necessary to check
-	// its package.json for the "main" directive
-	if knownLibs[libName] != true {
-		mainFile, err := DiscoverLibMainFile(libName)
-		if err != nil {
-			fmt.Println("NodeModules cannot resolve package main file of library ", libName)
-			return
-		}
+// loadingLock files are analyzed concurrently, guards loadedFiles
+var loadingLock sync.Mutex
 
-		targetFile = mainFile
+// AddNodeFile resolves a bare specifier imported by importer and exposes the
+// resolved file, returning the URL it is served from
+func AddNodeFile(specifier string, importer string) (string, error) {
+	targetFile, err := Resolve(specifier, importer)
+	if err != nil {
+		return "", err
 	}
 
+	ExposeFile(targetFile)
+
+	return PublicURL(targetFile), nil
+}
+
+// ExposeFile adds a file present in a node_modules folder to the known files,
+// served under NodePublicRoot
+func ExposeFile(targetFile string) {
+
 	// target file already loaded ? NOOP
+	loadingLock.Lock()
 	if loadedFiles[targetFile] == true {
+		loadingLock.Unlock()
 		return
 	}
+	loadedFiles[targetFile] = true
+	loadingLock.Unlock()
 
 	createdFile, createErr := files.Create(targetFile)
 	if createErr != nil {
-		fmt.Println("NodeModules could not read library file: ", file)
+		fmt.Println("NodeModules could not read library file: ", targetFile)
 		return
 	}
-	createdFile.PublicPath = filepath.Join(options.PublicRoot, NodePublicRoot, file)
+	createdFile.PublicPath = PublicURL(targetFile)
 
 	files.AddDefinition(createdFile)
-	loadedFiles[targetFile] = true
 
 }
 
-// DiscoverLibMainFile will check package.json to find the main file
-// of the imported lib
-func DiscoverLibMainFile(libName string) (string, error) {
+// PublicURL url of a node_modules file, relative to the project node_modules
+// root or "@fs/" followed by the absolute path for packages outside of it
+func PublicURL(file string) string {
+	relative, err := filepath.Rel(Root(), file)
+	if err != nil || strings.HasPrefix(relative, "..") {
+		return NodePublicRoot + "@fs/" + strings.TrimPrefix(filepath.ToSlash(file), "/")
+	}
 
-	libPath := filepath.Join(options.PublicRoot, options.NodeModulesRoot, libName)
-	// Does not know ? start discovery from entry point
-	packageJSON, err := ioutil.ReadFile(filepath.Join(libPath, "package.json"))
-	if err != nil {
-		return "", errors.New("Could not discover package JSON inside node_modules/" + libName)
+	return NodePublicRoot + filepath.ToSlash(relative)
+}
+
+// FileOf the file served at a NodePublicRoot url, only files inside of a
+// node_modules folder are accepted
+func FileOf(url string) (string, error) {
+	if !strings.HasPrefix(url, NodePublicRoot) {
+		return "", errors.New("Not a node module url: " + url)
 	}
-	var result map[string]string
-	json.Unmarshal([]byte(packageJSON), &result)
 
-	targetFile := filepath.Join(string(libPath), string(result["main"]))
+	relative := path.Clean("/" + strings.TrimPrefix(url, NodePublicRoot))
 
-	return targetFile, nil
+	file := filepath.Join(Root(), filepath.FromSlash(relative))
+	if strings.HasPrefix(relative, "/@fs/") {
+		file = filepath.FromSlash(strings.TrimPrefix(relative, "/@fs/"))
+		if !filepath.IsAbs(file) {
+			file = string(filepath.Separator) + file
+		}
 
-}
+		// Only the project and the packages its imports resolved to are
+		// served, not any node_modules folder of the disk
+		if !isInside(options.PublicRoot, file) && !isInside(Root(), file) && !IsResolvedPackageFile(file) {
+			return "", errors.New("Node module url outside of the resolved packages: " + url)
+		}
+	}
 
-// Register add node transformers for known extensions
-func Register() {
-	require.Register()
-	transform.AddFileTransformer(".js", NodeTransform)
+	if !IsNodeModuleFile(file) {
+		return "", errors.New("Node module url outside of node_modules: " + url)
+	}
+
+	return file, nil
 }
 
-var importMatcher = regexp.MustCompile(
-	"import\\s*(?P<name>.*)\\s*from.*(?P<path>\".*\"|'.*')(?:;?)",
+// Names of the transformers in pipelines
+const (
+	Name          = "node-modules"
+	GlobalsName   = "node-globals"
+	ImportMapName = "import-map"
 )
 
-var exportMatcher = regexp.MustCompile("module.exports\\s*=\\s*(?P<name>.*?);")
+// Register add node transformers for known extensions, node libraries are
+// searched in every extension of options.SearchForNodeModulesIn and in the
+// module extensions used by libraries
+func Register() {
+	require.Register()
+	moduleexports.Resolves = Resolves
+	moduleexports.Register()
+
+	transform.AddTransformer(transform.Transformer{
+		Name:       GlobalsName,
+		Extensions: []string{".js", ".mjs", ".cjs"},
+		Priority:   transform.PriorityModules,
+		Transform:  transform.Plain(ShimGlobals),
+	})
+
+	transform.AddTransformer(transform.Transformer{
+		Name:       Name,
+		Extensions: append([]string{".mjs", ".cjs"}, options.SearchForNodeModulesIn...),
+		Priority:   transform.PriorityResolve,
+		Transform:  transform.Plain(NodeTransform),
+	})
+
+	if UsesImportMap() {
+		transform.AddTransformer(transform.Transformer{
+			Name:       ImportMapName,
+			Extensions: []string{".html"},
+			Priority:   transform.PriorityResolve,
+			Transform:  transform.Plain(ImportMapTransform),
+		})
+	}
+}
 
-// NodeTransform Transform a node module
+// NodeTransform rewrites bare specifiers to the url of the node_modules file
+// they resolve to, or records them in the import map when it is used. Files
+// inside node_modules also get their relative specifiers rewritten to the
+// resolved file url
 var NodeTransform transform.FileTransformer = func(
 	path string,
 	content []byte,
 ) []byte {
 
-	// Find all submatches using import matcher
-	importMatches := importMatcher.FindAllSubmatch(content, -1)
-	importMatchesIndex := importMatcher.FindAllIndex(content, -1)
-	subNames := importMatcher.SubexpNames()
+	insideNodeModules := IsNodeModuleFile(path)
 
 	// all transformation will be done in this
 	newContent := []byte{}
 	lastIndex := 0
 
-	// Find all import matches -- First one is the whole match!
-	if importMatches != nil {
-		for ioSubMatch, subMatches := range importMatches {
-
-			if len(subMatches) > 0 {
-				name := subMatches[require.IndexOf("name", subNames)]
-
-				path := strings.ReplaceAll(
-					strings.ReplaceAll(
-						string(subMatches[require.IndexOf("path", subNames)]),
-						"'",
-						"",
-					),
-					"\"",
-					"",
-				)
-
-				startOfMatch := importMatchesIndex[ioSubMatch][0]
-				endOfMatch := importMatchesIndex[ioSubMatch][1]
-
-				if !strings.HasPrefix(path, "./") && !strings.HasPrefix(path, "/") {
-					path = NodePublicRoot + path
-					newContent = append(newContent, content[lastIndex:startOfMatch]...)
-					newContent = append(newContent, []byte("import "+string(name)+" from '"+string(path)+"';")...)
-					lastIndex = endOfMatch
-				}
+	for _, specifier := range jsscan.ModuleSpecifiers(jsscan.Tokenize(content)) {
+		var url string
+		var err error
+
+		switch {
+		case IsBareSpecifier(specifier.Value) && UsesImportMap():
+			// The import map points the browser to the file
+			if url, err = AddNodeFile(specifier.Value, path); err == nil {
+				AddImport(specifier.Value, path, url)
+				continue
 			}
+		case IsBareSpecifier(specifier.Value):
+			url, err = AddNodeFile(specifier.Value, path)
+		case insideNodeModules && strings.HasPrefix(specifier.Value, "."):
+			url, err = AddRelativeNodeFile(specifier.Value, path)
+		default:
+			continue
 		}
+
+		if err != nil {
+			diagnostics.Warnf("Node Modules", path, "could not resolve %q: %s", specifier.Value, err)
+			continue
+		}
+
+		newContent = append(newContent, content[lastIndex:specifier.Token.Start]...)
+		newContent = append(newContent, []byte(jsscan.Quote(url))...)
+		lastIndex = specifier.Token.End
 	}
 	newContent = append(newContent, content[lastIndex:]...)
 
-	// wrap up import, try to find exports
-	content = newContent
-	newContent = []byte{}
-	lastIndex = 0
-	exportName := []byte{}
-	// Try exports
-	exportMatches := exportMatcher.FindAllSubmatch(content, -1)
-	exportMatchesIndex := exportMatcher.FindAllIndex(content, -1)
-	eSubNames := exportMatcher.SubexpNames()
-	if exportMatches != nil {
-		for ioSubMatch, subMatches := range exportMatches {
-
-			if len(subMatches) > 0 {
-				name := subMatches[require.IndexOf("name", eSubNames)]
-				exportName = name
-				startOfMatch := exportMatchesIndex[ioSubMatch][0]
-				endOfMatch := exportMatchesIndex[ioSubMatch][1]
-
-				newContent = append(newContent, content[lastIndex:startOfMatch]...)
-				newContent = append(newContent, []byte("export { "+string(name)+" };")...)
-
-				lastIndex = endOfMatch
-			}
+	return newContent
+}
+
+// AddRelativeNodeFile resolves a relative specifier imported by a file inside
+// node_modules, applying the browser replacements of its package, and exposes
+// the resolved file
+func AddRelativeNodeFile(specifier string, importer string) (string, error) {
+	targetFile, err := resolveFile(filepath.Join(filepath.Dir(importer), filepath.FromSlash(specifier)))
+	if err != nil {
+		return "", err
+	}
+
+	if pkg, pkgErr := NearestPackageJSON(filepath.Dir(targetFile)); pkgErr == nil {
+		if targetFile, err = BrowserRemap(pkg, targetFile); err != nil {
+			return "", err
 		}
 	}
 
-	newContent = append(newContent, content[lastIndex:]...)
-	newContent = bytes.ReplaceAll(newContent, []byte("module.exports"), exportName)
+	ExposeFile(targetFile)
 
-	return newContent
+	return PublicURL(targetFile), nil
+}
+
+// Resolves the specifier imported by importer resolves to a file, absolute
+// urls are left to the browser
+func Resolves(specifier string, importer string) bool {
+	if IsBareSpecifier(specifier) {
+		_, err := Resolve(specifier, importer)
+		return err == nil
+	}
+
+	if strings.HasPrefix(specifier, ".") {
+		_, err := resolveFile(filepath.Join(filepath.Dir(importer), filepath.FromSlash(specifier)))
+		return err == nil
+	}
+
+	return true
+}
+
+// isInside the file is inside of dir
+func isInside(dir string, file string) bool {
+	relative, err := filepath.Rel(dir, file)
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator))
+}
+
+// IsNodeModuleFile the file is inside a node_modules folder
+func IsNodeModuleFile(file string) bool {
+	return strings.Contains(filepath.ToSlash(file), "/node_modules/")
+}
+
+// IsBareSpecifier the specifier names a package instead of a relative or
+// absolute url
+func IsBareSpecifier(specifier string) bool {
+	if strings.HasPrefix(specifier, "node:") {
+		return true
+	}
+
+	return specifier != "" &&
+		!strings.HasPrefix(specifier, ".") &&
+		!strings.HasPrefix(specifier, "/") &&
+		!strings.Contains(specifier, ":")
 }
 
 // NodeLib node library
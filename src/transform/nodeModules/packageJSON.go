@@ -0,0 +1,126 @@
+package nodemodules
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// PackageJSON fields of a package.json used to resolve the package files
+type PackageJSON struct {
+	Name    string          `json:"name"`
+	Version string          `json:"version"`
+	Main    string          `json:"main"`
+	Module  string          `json:"module"`
+	Browser json.RawMessage `json:"browser"`
+	Exports json.RawMessage `json:"exports"`
+	Imports json.RawMessage `json:"imports"`
+
+	Dependencies map[string]string `json:"dependencies"`
+
+	// Dir directory containing the package.json
+	Dir string `json:"-"`
+}
+
+// jsonEntry key/value of a json object, keeping the declaration order
+type jsonEntry struct {
+	Key   string
+	Value json.RawMessage
+}
+
+var loadedPackages = map[string]*PackageJSON{}
+var packagesLock sync.Mutex
+
+// LoadPackageJSON reads the package.json inside dir, package.json files are
+// read only once
+func LoadPackageJSON(dir string) (*PackageJSON, error) {
+	packagesLock.Lock()
+	defer packagesLock.Unlock()
+
+	if pkg, loaded := loadedPackages[dir]; loaded {
+		if pkg == nil {
+			return nil, errors.New("Could not read package.json in " + dir)
+		}
+		return pkg, nil
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		loadedPackages[dir] = nil
+		return nil, errors.New("Could not read package.json in " + dir)
+	}
+
+	pkg := &PackageJSON{}
+	if err := json.Unmarshal(content, pkg); err != nil {
+		loadedPackages[dir] = nil
+		return nil, errors.New("Invalid package.json in " + dir + ": " + err.Error())
+	}
+	pkg.Dir = dir
+
+	loadedPackages[dir] = pkg
+	return pkg, nil
+}
+
+// NearestPackageJSON walks up from dir until a package.json is found
+func NearestPackageJSON(dir string) (*PackageJSON, error) {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "package.json")); err == nil {
+			return LoadPackageJSON(dir)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil, errors.New("No package.json found above " + dir)
+		}
+		dir = parent
+	}
+}
+
+// BrowserMain the entry point declared by a "browser" string
+func (pkg *PackageJSON) BrowserMain() string {
+	var main string
+	if json.Unmarshal(pkg.Browser, &main) == nil {
+		return main
+	}
+	return ""
+}
+
+// BrowserRemaps the replacements declared by a "browser" object, a false
+// value excludes the file or module from the browser
+func (pkg *PackageJSON) BrowserRemaps() map[string]interface{} {
+	remaps := map[string]interface{}{}
+	json.Unmarshal(pkg.Browser, &remaps)
+	return remaps
+}
+
+// objectEntries decodes a json object keeping the order of its keys, which
+// is meaningful for "exports" conditions
+func objectEntries(raw json.RawMessage) ([]jsonEntry, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+
+	token, err := decoder.Token()
+	if err != nil || token != json.Delim('{') {
+		return nil, false
+	}
+
+	entries := []jsonEntry{}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, false
+		}
+
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, false
+		}
+
+		entries = append(entries, jsonEntry{Key: key.(string), Value: value})
+	}
+
+	return entries, true
+}
@@ -0,0 +1,380 @@
+package nodemodules
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/nonanick/impatience/options"
+	"github.com/nonanick/impatience/transform/jsscan"
+	"github.com/nonanick/impatience/transform/moduleexports"
+)
+
+// PrebundleDir folder inside the node_modules root holding the bundles
+var PrebundleDir = filepath.Join(".impatience", "deps")
+
+// prebundleManifest file of a bundle folder listing its entry modules, it
+// is written last so an interrupted build is done again
+const prebundleManifest = "manifest.json"
+
+// prebundle bundle of a package, the entry points share their modules
+// through chunks so the package state is loaded once
+type prebundle struct {
+	Dir string `json:"-"`
+	// Entries maps a subpath of the package ("." or "./sub") to the file
+	// name of its module inside Dir
+	Entries map[string]string `json:"entries"`
+}
+
+// prebundled maps a package directory to its bundle
+var prebundled = map[string]prebundle{}
+var prebundleLock sync.RWMutex
+
+// Prebundle bundles options.PrebundlePackages and the project dependencies
+// reaching options.PrebundleThreshold modules, bundles are kept on disk and
+// reused while the package version does not change
+func Prebundle() {
+	packages := append([]string{}, options.PrebundlePackages...)
+	if options.PrebundleThreshold > 0 {
+		packages = append(packages, detectHeavyDependencies(options.PrebundleThreshold)...)
+	}
+
+	done := map[string]bool{}
+	for _, name := range packages {
+		if done[name] {
+			continue
+		}
+		done[name] = true
+
+		bundle, err := PrebundlePackage(name)
+		if err != nil {
+			fmt.Println("NodeModules could not pre-bundle", name, ":", err)
+			continue
+		}
+		fmt.Println("NodeModules pre-bundled", name, "into", bundle)
+	}
+}
+
+// PrebundlePackage bundles the entry point of a package and the subpaths
+// listed in its "exports" with their internal modules, other packages stay
+// as imports. Return the folder of the bundle
+func PrebundlePackage(name string) (string, error) {
+	packageDir, err := FindPackage(name, options.PublicRoot)
+	if err != nil {
+		return "", err
+	}
+
+	pkg, err := LoadPackageJSON(packageDir)
+	if err != nil {
+		return "", err
+	}
+
+	bundle := prebundle{Dir: filepath.Join(Root(), PrebundleDir, bundleName(name, pkg.Version))}
+
+	manifest, readErr := ioutil.ReadFile(filepath.Join(bundle.Dir, prebundleManifest))
+	if readErr != nil || json.Unmarshal(manifest, &bundle) != nil || len(bundle.Entries) == 0 {
+		if bundle.Entries, err = buildBundle(packageEntries(packageDir, pkg), packageDir, bundle.Dir); err != nil {
+			return "", err
+		}
+
+		manifest, _ = json.Marshal(bundle)
+		if err := ioutil.WriteFile(filepath.Join(bundle.Dir, prebundleManifest), manifest, 0644); err != nil {
+			return "", err
+		}
+	}
+
+	prebundleLock.Lock()
+	prebundled[packageDir] = bundle
+	prebundleLock.Unlock()
+
+	return bundle.Dir, nil
+}
+
+// PrebundleOf the bundle module serving a subpath of the package
+func PrebundleOf(packageDir string, subpath string) (string, bool) {
+	prebundleLock.RLock()
+	defer prebundleLock.RUnlock()
+
+	bundle, isPrebundled := prebundled[packageDir]
+	if !isPrebundled {
+		return "", false
+	}
+
+	file, isEntry := bundle.Entries[subpath]
+	if !isEntry {
+		return "", false
+	}
+	return filepath.Join(bundle.Dir, file), true
+}
+
+// PrebundleSourceOf the package directory a bundle module was built from,
+// imports of the bundle resolve as if made by that package
+func PrebundleSourceOf(file string) (string, bool) {
+	prebundleLock.RLock()
+	defer prebundleLock.RUnlock()
+
+	for packageDir, bundle := range prebundled {
+		if isInside(bundle.Dir, file) {
+			return packageDir, true
+		}
+	}
+	return "", false
+}
+
+// bundleName folder name of a package bundle, "@scope/pkg" 1.0.0 is stored
+// as "@scope+pkg@1.0.0"
+func bundleName(name string, version string) string {
+	if version == "" {
+		version = "0.0.0"
+	}
+	return strings.ReplaceAll(name, "/", "+") + "@" + version
+}
+
+// packageEntries resolved files of the package entry point and of the
+// javascript subpaths listed in its "exports", patterns are left out
+func packageEntries(packageDir string, pkg *PackageJSON) map[string]string {
+	subpaths := []string{"."}
+	if entries, isObject := objectEntries(pkg.Exports); isObject {
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Key, "./") && !strings.Contains(entry.Key, "*") &&
+				!strings.HasSuffix(entry.Key, "/") && entry.Key != "./package.json" {
+				subpaths = append(subpaths, entry.Key)
+			}
+		}
+	}
+
+	files := map[string]string{}
+	for _, subpath := range subpaths {
+		file, err := resolvePackageSubpath(packageDir, subpath)
+		if err != nil {
+			continue
+		}
+
+		switch filepath.Ext(file) {
+		case ".js", ".mjs", ".cjs":
+			files[subpath] = file
+		}
+	}
+
+	return files
+}
+
+// entryNamespace esbuild namespace of the modules re-exporting a CommonJS
+// entry point with its named exports
+const entryNamespace = "impatience-entry"
+
+// buildBundle bundles the entries with esbuild using the browser conditions
+// into dir, return the file name of the module of each subpath
+func buildBundle(entries map[string]string, packageDir string, dir string) (map[string]string, error) {
+	if _, hasMain := entries["."]; !hasMain {
+		return nil, errors.New("the package entry point is not a javascript module")
+	}
+
+	entryPoints := []api.EntryPoint{}
+	outputs := map[string]string{}
+	wrappers := map[string]string{}
+
+	for subpath, file := range entries {
+		output := "index"
+		if subpath != "." {
+			output = strings.ReplaceAll(strings.TrimPrefix(subpath, "./"), "/", "+")
+		}
+
+		// "./index" is the entry point under another name, resolved without
+		// the bundle
+		if subpath != "." && output == "index" {
+			continue
+		}
+		outputs[subpath] = output + ".js"
+
+		// esbuild only gives CommonJS modules a default export, the wrapper
+		// adds the names the interop transformer would export
+		input := file
+		if content, err := ioutil.ReadFile(file); err == nil && moduleexports.IsCommonJS(content) {
+			input = entryNamespace + ":" + subpath
+			wrappers[subpath] = commonJSEntry(file)
+		}
+
+		entryPoints = append(entryPoints, api.EntryPoint{InputPath: input, OutputPath: output})
+	}
+
+	result := api.Build(api.BuildOptions{
+		EntryPointsAdvanced: entryPoints,
+		AbsWorkingDir:       packageDir,
+		Outdir:              dir,
+		ChunkNames:          "chunk-[hash]",
+		Bundle:              true,
+		Splitting:           true,
+		Write:               false,
+		Format:              api.FormatESModule,
+		Platform:            api.PlatformBrowser,
+		Conditions:          Conditions,
+		Packages:            api.PackagesExternal,
+		LogLevel:            api.LogLevelSilent,
+		Plugins: []api.Plugin{{
+			Name: entryNamespace,
+			Setup: func(build api.PluginBuild) {
+				build.OnResolve(api.OnResolveOptions{Filter: "^" + entryNamespace + ":"},
+					func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+						return api.OnResolveResult{
+							Path:      strings.TrimPrefix(args.Path, entryNamespace+":"),
+							Namespace: entryNamespace,
+						}, nil
+					})
+				build.OnLoad(api.OnLoadOptions{Filter: ".*", Namespace: entryNamespace},
+					func(args api.OnLoadArgs) (api.OnLoadResult, error) {
+						contents := wrappers[args.Path]
+						return api.OnLoadResult{Contents: &contents, ResolveDir: packageDir, Loader: api.LoaderJS}, nil
+					})
+			},
+		}},
+	})
+
+	if len(result.Errors) > 0 {
+		messages := []string{}
+		for _, message := range result.Errors {
+			messages = append(messages, message.Text)
+		}
+		return nil, errors.New(strings.Join(messages, "; "))
+	}
+
+	if len(result.OutputFiles) == 0 {
+		return nil, errors.New("esbuild produced no output for " + packageDir)
+	}
+
+	// Files of an older build of the same version are removed
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	for _, output := range result.OutputFiles {
+		if err := ioutil.WriteFile(output.Path, output.Contents, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	return outputs, nil
+}
+
+// commonJSEntry module re-exporting a CommonJS file with the names it
+// exports, following "module.exports = require('./x')"
+func commonJSEntry(file string) string {
+	specifier := jsscan.Quote(file)
+	entry := "export { default } from " + specifier + ";\n"
+
+	names := []string{}
+	for _, name := range commonJSNames(file, map[string]bool{}) {
+		if name != "default" {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		entry += "export { " + strings.Join(names, ", ") + " } from " + specifier + ";\n"
+	}
+
+	return entry
+}
+
+// commonJSNames names exported by a CommonJS file and by the files it
+// replaces its exports with
+func commonJSNames(file string, visited map[string]bool) []string {
+	if visited[file] {
+		return []string{}
+	}
+	visited[file] = true
+
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return []string{}
+	}
+
+	names := moduleexports.ExportedNames(content)
+	for _, specifier := range moduleexports.ReexportedModules(content) {
+		if !strings.HasPrefix(specifier, ".") {
+			continue
+		}
+
+		target, err := resolveFile(filepath.Join(filepath.Dir(file), filepath.FromSlash(specifier)))
+		if err != nil {
+			continue
+		}
+
+		for _, name := range commonJSNames(target, visited) {
+			if !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+
+	return names
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// detectHeavyDependencies dependencies of the project package.json with at
+// least threshold javascript modules
+func detectHeavyDependencies(threshold int) []string {
+	project, err := NearestPackageJSON(options.PublicRoot)
+	if err != nil {
+		return []string{}
+	}
+
+	heavy := []string{}
+	for name := range project.Dependencies {
+		packageDir, err := FindPackage(name, options.PublicRoot)
+		if err != nil {
+			continue
+		}
+
+		if countModules(packageDir, threshold) >= threshold {
+			heavy = append(heavy, name)
+		}
+	}
+
+	return heavy
+}
+
+// countModules counts the javascript files of a package, without its own
+// node_modules, stopping once limit is reached
+func countModules(packageDir string, limit int) int {
+	count := 0
+	errLimitReached := errors.New("limit reached")
+
+	filepath.Walk(packageDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if info.IsDir() && info.Name() == "node_modules" {
+			return filepath.SkipDir
+		}
+
+		switch filepath.Ext(path) {
+		case ".js", ".mjs", ".cjs":
+			count++
+		}
+
+		if count >= limit {
+			return errLimitReached
+		}
+		return nil
+	})
+
+	return count
+}
@@ -0,0 +1,423 @@
+package nodemodules
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nonanick/impatience/options"
+)
+
+// Conditions accepted when resolving the "exports" and "imports" of a
+// package, the first matching condition declared by the package wins
+var Conditions = []string{"browser", "import", "default"}
+
+// ResolveExtensions tried when a resolved file does not exist as it is
+var ResolveExtensions = []string{".js", ".mjs", ".cjs", ".json"}
+
+// Root absolute path of the project node_modules folder
+func Root() string {
+	if filepath.IsAbs(options.NodeModulesRoot) {
+		return options.NodeModulesRoot
+	}
+	return filepath.Join(options.PublicRoot, options.NodeModulesRoot)
+}
+
+// Resolve finds the file a bare specifier ("lit", "@scope/pkg/sub" or a
+// "#subpath" import) refers to when imported by importer, following Node's
+// resolution algorithm with the browser conditions. Node built-ins resolve
+// to their shims and modules excluded by a "browser" field to an empty
+// module. An empty importer resolves from the public root
+func Resolve(specifier string, importer string) (string, error) {
+	from := options.PublicRoot
+	if importer != "" {
+		from = filepath.Dir(importer)
+	}
+
+	// A bundle imports other packages as the package it was built from
+	if packageDir, isBundle := PrebundleSourceOf(importer); isBundle && importer != "" {
+		importer = filepath.Join(packageDir, "package.json")
+		from = packageDir
+	}
+
+	// The importer package may replace the module for browsers
+	if importerPkg, err := NearestPackageJSON(from); err == nil && importer != "" {
+		if remap, remapped := importerPkg.BrowserRemaps()[specifier]; remapped {
+			target, isString := remap.(string)
+			if !isString {
+				return StubFile(EmptyModule)
+			}
+			if strings.HasPrefix(target, ".") {
+				return resolveFile(filepath.Join(importerPkg.Dir, target))
+			}
+			specifier = target
+		}
+	}
+
+	if IsBuiltin(specifier) {
+		return resolveBuiltin(specifier, importer, from)
+	}
+
+	if strings.HasPrefix(specifier, "#") {
+		return resolveSubpathImport(specifier, from)
+	}
+
+	return resolvePackage(specifier, from)
+}
+
+// resolvePackage resolves a package name, with an optional subpath, from the
+// node_modules folders above dir
+func resolvePackage(specifier string, dir string) (string, error) {
+	name, subpath := SplitSpecifier(specifier)
+	if name == "" {
+		return "", errors.New("Invalid package specifier " + specifier)
+	}
+
+	packageDir, err := FindPackage(name, dir)
+	if err != nil {
+		return "", err
+	}
+
+	if bundle, isPrebundled := PrebundleOf(packageDir, subpath); isPrebundled {
+		return bundle, nil
+	}
+
+	return resolvePackageSubpath(packageDir, subpath)
+}
+
+// SplitSpecifier splits a bare specifier into the package name and the
+// subpath inside of it, "@scope/pkg/a/b" returns "@scope/pkg" and "./a/b"
+func SplitSpecifier(specifier string) (string, string) {
+	parts := strings.Split(specifier, "/")
+
+	nameSize := 1
+	if strings.HasPrefix(specifier, "@") {
+		nameSize = 2
+	}
+
+	if len(parts) < nameSize || parts[0] == "" || parts[nameSize-1] == "" {
+		return "", ""
+	}
+
+	name := strings.Join(parts[:nameSize], "/")
+	subpath := "."
+	if len(parts) > nameSize {
+		subpath = "./" + strings.Join(parts[nameSize:], "/")
+	}
+
+	return name, subpath
+}
+
+// FindPackage walks up from dir looking for node_modules/name, the project
+// node_modules root is tried last. Symlinks are followed so packages
+// installed by pnpm resolve their own dependencies from their real location
+func FindPackage(name string, dir string) (string, error) {
+	candidates := []string{}
+
+	for {
+		if filepath.Base(dir) != "node_modules" {
+			candidates = append(candidates, filepath.Join(dir, "node_modules", name))
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	candidates = append(candidates, filepath.Join(Root(), name))
+
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			if real, err := filepath.EvalSymlinks(candidate); err == nil {
+				candidate = real
+			}
+			rememberPackage(candidate)
+			return candidate, nil
+		}
+	}
+
+	return "", errors.New("Could not find package " + name + " in any node_modules folder")
+}
+
+// resolvedPackages package folders returned by FindPackage, the only
+// folders outside of the project served through "@fs/" urls
+var resolvedPackages = map[string]bool{}
+var resolvedPackagesLock sync.RWMutex
+
+func rememberPackage(packageDir string) {
+	resolvedPackagesLock.Lock()
+	resolvedPackages[packageDir] = true
+	resolvedPackagesLock.Unlock()
+}
+
+// IsResolvedPackageFile the file is inside a package folder returned by
+// FindPackage
+func IsResolvedPackageFile(file string) bool {
+	resolvedPackagesLock.RLock()
+	defer resolvedPackagesLock.RUnlock()
+
+	for dir := file; ; {
+		if resolvedPackages[dir] {
+			return true
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+// resolvePackageSubpath resolves "." or "./sub" inside of a package
+func resolvePackageSubpath(packageDir string, subpath string) (string, error) {
+	pkg, err := LoadPackageJSON(packageDir)
+	if err != nil {
+		// Packages without package.json are plain directories
+		return resolveFile(filepath.Join(packageDir, subpath))
+	}
+
+	if len(pkg.Exports) > 0 && string(pkg.Exports) != "null" {
+		target, err := resolveExports(pkg.Exports, subpath)
+		if err != nil {
+			return "", errors.New(pkg.Name + ": " + err.Error())
+		}
+		return resolveFile(filepath.Join(packageDir, target))
+	}
+
+	target := subpath
+	if subpath == "." {
+		target = entryPoint(pkg)
+	}
+
+	return resolvePackageFile(pkg, filepath.Join(packageDir, target))
+}
+
+// entryPoint main file of a package without "exports"
+func entryPoint(pkg *PackageJSON) string {
+	if main := pkg.BrowserMain(); main != "" {
+		return main
+	}
+	if pkg.Module != "" {
+		return pkg.Module
+	}
+	if pkg.Main != "" {
+		return pkg.Main
+	}
+	return "index.js"
+}
+
+// resolvePackageFile resolves a file of the package and apply the browser
+// replacements the package declares for it
+func resolvePackageFile(pkg *PackageJSON, file string) (string, error) {
+	resolved, err := resolveFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	return BrowserRemap(pkg, resolved)
+}
+
+// BrowserRemap applies the "browser" object of the package to one of its
+// files, keys may omit the extension
+func BrowserRemap(pkg *PackageJSON, file string) (string, error) {
+	remaps := pkg.BrowserRemaps()
+	if len(remaps) == 0 {
+		return file, nil
+	}
+
+	relative, err := filepath.Rel(pkg.Dir, file)
+	if err != nil {
+		return file, nil
+	}
+	relative = filepath.ToSlash(relative)
+	withoutExtension := strings.TrimSuffix(relative, path.Ext(relative))
+
+	for key, remap := range remaps {
+		cleanKey := path.Clean(key)
+		if cleanKey != relative && cleanKey != withoutExtension {
+			continue
+		}
+
+		target, isString := remap.(string)
+		if !isString {
+			return StubFile(EmptyModule)
+		}
+		return resolveFile(filepath.Join(pkg.Dir, target))
+	}
+
+	return file, nil
+}
+
+// resolveSubpathImport resolves "#name" using the "imports" of the package
+// containing dir
+func resolveSubpathImport(specifier string, dir string) (string, error) {
+	pkg, err := NearestPackageJSON(dir)
+	if err != nil {
+		return "", errors.New("Subpath import " + specifier + " used outside of a package")
+	}
+
+	entries, isObject := objectEntries(pkg.Imports)
+	if !isObject {
+		return "", errors.New(pkg.Name + " does not declare \"imports\"")
+	}
+
+	target, err := matchSubpath(entries, specifier)
+	if err != nil {
+		return "", errors.New(pkg.Name + ": " + err.Error())
+	}
+
+	// Imports may point to other packages
+	if !strings.HasPrefix(target, "./") {
+		return Resolve(target, filepath.Join(pkg.Dir, "package.json"))
+	}
+
+	return resolveFile(filepath.Join(pkg.Dir, target))
+}
+
+// resolveExports finds the target of a subpath in the "exports" field
+func resolveExports(exports json.RawMessage, subpath string) (string, error) {
+	entries, isObject := objectEntries(exports)
+
+	// "exports": "./index.js", [...] or only conditions are sugar for "."
+	isSubpathMap := isObject && len(entries) > 0 && strings.HasPrefix(entries[0].Key, ".")
+	if !isSubpathMap {
+		if subpath != "." {
+			return "", errors.New("subpath " + subpath + " is not exported")
+		}
+		return resolveTarget(exports, "")
+	}
+
+	return matchSubpath(entries, subpath)
+}
+
+// matchSubpath matches a subpath against "exports"/"imports" keys, exact
+// keys first then the longest "*" pattern or folder ending in "/"
+func matchSubpath(entries []jsonEntry, subpath string) (string, error) {
+	for _, entry := range entries {
+		if entry.Key == subpath && !strings.Contains(entry.Key, "*") {
+			return resolveTarget(entry.Value, "")
+		}
+	}
+
+	bestKey, bestMatch := "", ""
+	var bestValue json.RawMessage
+
+	for _, entry := range entries {
+		key := entry.Key
+		star := strings.Index(key, "*")
+
+		match := ""
+		switch {
+		case star >= 0:
+			prefix, suffix := key[:star], key[star+1:]
+			if !strings.HasPrefix(subpath, prefix) || !strings.HasSuffix(subpath, suffix) ||
+				len(subpath) < len(key)-1 {
+				continue
+			}
+			match = subpath[len(prefix) : len(subpath)-len(suffix)]
+		case strings.HasSuffix(key, "/") && strings.HasPrefix(subpath, key):
+			match = subpath[len(key):]
+		default:
+			continue
+		}
+
+		if len(key) > len(bestKey) {
+			bestKey, bestMatch, bestValue = key, match, entry.Value
+		}
+	}
+
+	if bestKey == "" {
+		return "", errors.New("subpath " + subpath + " is not exported")
+	}
+
+	if strings.HasSuffix(bestKey, "/") {
+		target, err := resolveTarget(bestValue, "")
+		return target + bestMatch, err
+	}
+
+	return resolveTarget(bestValue, bestMatch)
+}
+
+// resolveTarget resolves a target: a path, a list of fallbacks or an object
+// of conditions
+func resolveTarget(target json.RawMessage, match string) (string, error) {
+	if strings.TrimSpace(string(target)) == "null" {
+		return "", errors.New("target is excluded with null")
+	}
+
+	var file string
+	if json.Unmarshal(target, &file) == nil {
+		return strings.Replace(file, "*", match, -1), nil
+	}
+
+	var fallbacks []json.RawMessage
+	if json.Unmarshal(target, &fallbacks) == nil {
+		for _, fallback := range fallbacks {
+			if resolved, err := resolveTarget(fallback, match); err == nil {
+				return resolved, nil
+			}
+		}
+		return "", errors.New("no fallback target can be used")
+	}
+
+	if conditions, isObject := objectEntries(target); isObject {
+		for _, condition := range conditions {
+			if isCondition(condition.Key) {
+				if resolved, err := resolveTarget(condition.Value, match); err == nil {
+					return resolved, nil
+				}
+			}
+		}
+		return "", errors.New("no condition matches " + strings.Join(Conditions, ", "))
+	}
+
+	return "", errors.New("target is not exported")
+}
+
+func isCondition(key string) bool {
+	for _, condition := range Conditions {
+		if condition == key {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveFile resolves a path as a file, with one of the ResolveExtensions
+// or as a directory with a package.json or index file
+func resolveFile(file string) (string, error) {
+	if info, err := os.Stat(file); err == nil && !info.IsDir() {
+		return file, nil
+	}
+
+	for _, extension := range ResolveExtensions {
+		if info, err := os.Stat(file + extension); err == nil && !info.IsDir() {
+			return file + extension, nil
+		}
+	}
+
+	if info, err := os.Stat(file); err == nil && info.IsDir() {
+		if pkg, err := LoadPackageJSON(file); err == nil {
+			if main := entryPoint(pkg); main != "index.js" {
+				if resolved, err := resolvePackageFile(pkg, filepath.Join(file, main)); err == nil {
+					return resolved, nil
+				}
+			}
+		}
+
+		for _, extension := range ResolveExtensions {
+			index := filepath.Join(file, "index"+extension)
+			if _, err := os.Stat(index); err == nil {
+				return index, nil
+			}
+		}
+	}
+
+	return "", errors.New("Could not resolve file " + file)
+}
@@ -0,0 +1,195 @@
+package nodemodules
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nonanick/impatience/diagnostics"
+	"github.com/nonanick/impatience/options"
+	"github.com/nonanick/impatience/transform/jsscan"
+)
+
+// Builtins node built-in modules, importing them from the browser resolves
+// to the shim configured in options.NodeShims
+var Builtins = []string{
+	"assert", "async_hooks", "buffer", "child_process", "cluster", "console",
+	"constants", "crypto", "dgram", "diagnostics_channel", "dns", "domain",
+	"events", "fs", "fs/promises", "http", "http2", "https", "inspector",
+	"module", "net", "os", "path", "perf_hooks", "process", "punycode",
+	"querystring", "readline", "repl", "stream", "stream/promises",
+	"string_decoder", "sys", "timers", "tls", "tty", "url", "util", "v8",
+	"vm", "worker_threads", "zlib",
+}
+
+// ShimsDir folder inside the node_modules root holding the built-in stubs
+var ShimsDir = filepath.Join(".impatience", "shims")
+
+// EmptyModule name of the stub used by modules excluded from the browser
+const EmptyModule = "empty"
+
+// stubs content of the built-in stubs, any other name gets an empty module
+var stubs = map[string]string{
+	"process": `var process = {
+	env: {},
+	argv: [],
+	browser: true,
+	platform: "browser",
+	title: "browser",
+	version: "",
+	versions: {},
+	cwd: function () { return "/"; },
+	nextTick: function (callback) {
+		var args = Array.prototype.slice.call(arguments, 1);
+		Promise.resolve().then(function () { callback.apply(null, args); });
+	},
+};
+export default process;
+export { process as __cjsExports };
+`,
+}
+
+const emptyStub = `var empty = {};
+export default empty;
+export { empty as __cjsExports };
+`
+
+var writtenStubs = map[string]bool{}
+var stubsLock sync.Mutex
+
+// IsBuiltin the specifier is a node built-in module, with or without the
+// "node:" prefix
+func IsBuiltin(specifier string) bool {
+	if strings.HasPrefix(specifier, "node:") {
+		return true
+	}
+
+	for _, builtin := range Builtins {
+		if builtin == specifier {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveBuiltin resolves a built-in to its browser package, or to a stub
+// when no package is configured or installed
+func resolveBuiltin(specifier string, importer string, from string) (string, error) {
+	name := strings.TrimPrefix(specifier, "node:")
+
+	if shim := options.NodeShims[name]; shim != "" {
+		if file, err := resolvePackage(shim, from); err == nil {
+			return file, nil
+		}
+	}
+
+	if _, hasStub := stubs[name]; !hasStub && importer != "" {
+		diagnostics.Warnf(
+			"Node Shims", importer,
+			"node built-in %q has no browser package installed, it is replaced by an empty module",
+			specifier,
+		)
+	}
+
+	return StubFile(name)
+}
+
+// StubFile writes the stub of a built-in inside ShimsDir, returning its path
+func StubFile(name string) (string, error) {
+	file := filepath.Join(Root(), ShimsDir, strings.ReplaceAll(name, "/", "+")+".js")
+
+	stubsLock.Lock()
+	defer stubsLock.Unlock()
+
+	if writtenStubs[file] {
+		return file, nil
+	}
+
+	content, hasStub := stubs[name]
+	if !hasStub {
+		content = emptyStub
+	}
+
+	if current, err := ioutil.ReadFile(file); err != nil || !bytes.Equal(current, []byte(content)) {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			return "", err
+		}
+	}
+
+	writtenStubs[file] = true
+	return file, nil
+}
+
+// ShimGlobals defines the node globals used by node_modules files, "process"
+// and "Buffer" are imported from their shims and "global" is globalThis
+func ShimGlobals(path string, content []byte) []byte {
+	if !options.ShimNodeGlobals || !IsNodeModuleFile(path) {
+		return content
+	}
+
+	// The shim packages define the globals themselves
+	shimPackage := ""
+	if pkg, err := NearestPackageJSON(filepath.Dir(path)); err == nil {
+		shimPackage = pkg.Name
+	}
+
+	tokens := jsscan.Tokenize(content)
+	definitions := ""
+
+	if usesGlobal(tokens, "process") && shimPackage != options.NodeShims["process"] {
+		definitions += "import process from \"process\";\n"
+	}
+
+	if usesGlobal(tokens, "global") {
+		definitions += "var global = globalThis;\n"
+	}
+
+	// A stub can't provide the named Buffer export, only the real shim
+	if usesGlobal(tokens, "Buffer") && shimPackage != options.NodeShims["buffer"] {
+		if _, err := resolvePackage(options.NodeShims["buffer"], filepath.Dir(path)); err == nil {
+			definitions += "import { Buffer } from \"buffer\";\n"
+		} else {
+			diagnostics.Warnf("Node Shims", path, "Buffer is used but no buffer package is installed")
+		}
+	}
+
+	if definitions == "" {
+		return content
+	}
+
+	return append([]byte(definitions), content...)
+}
+
+// usesGlobal the code references name without declaring it at the top level
+func usesGlobal(tokens []jsscan.Token, name string) bool {
+	used := false
+
+	for index, token := range tokens {
+		if !token.Is(name) {
+			continue
+		}
+
+		if index > 0 {
+			previous := tokens[index-1]
+			if previous.Is(".") || previous.Is("?.") {
+				continue
+			}
+
+			if token.Depth == 0 && (previous.Is("var") || previous.Is("let") ||
+				previous.Is("const") || previous.Is("function") || previous.Is("class") ||
+				previous.Is("import") || previous.Is("as")) {
+				return false
+			}
+		}
+
+		used = true
+	}
+
+	return used
+}
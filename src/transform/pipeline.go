@@ -0,0 +1,198 @@
+package transform
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nonanick/impatience/options"
+	"github.com/nonanick/impatience/transform/sourcemap"
+)
+
+// Priorities of the built-in transformers, transformers run by ascending
+// priority and in registration order when they share one
+const (
+	// PriorityTranspile languages compiled to javascript or css
+	PriorityTranspile = 100
+	// PriorityDefine replacement of defined expressions
+	PriorityDefine = 200
+	// PriorityModules conversion of node module formats and globals
+	PriorityModules = 300
+	// PriorityResolve rewriting of bare specifiers
+	PriorityResolve = 400
+	// PriorityImports rewriting of imports of proxied files
+	PriorityImports = 500
+	// DefaultPriority transformers added without a priority run last
+	DefaultPriority = 1000
+)
+
+// AllTransformers used in a pipeline stands for every transformer of the
+// file extension, in priority order
+const AllTransformers = "*"
+
+// Transformer file transformer registered for some extensions, pipelines
+// refer to transformers by their name
+type Transformer struct {
+	Name       string
+	Extensions []string
+	Priority   int
+	Transform  MappedFileTransformer
+	// Checked used instead of Transform when set, for transformers whose
+	// output may not be a transformation of the content
+	Checked CheckedFileTransformer
+
+	// Version of the transformer output, outputs of transformers with a
+	// version are kept in the disk cache. Only transformers without side
+	// effects (besides diagnostics) can be cached
+	Version string
+	// Config describes the configuration the output depends on, part of
+	// the cache key
+	Config func() string
+}
+
+// apply runs the transformer, telling if the output is the transformation
+// of the content
+func (transformer Transformer) apply(path string, content []byte) ([]byte, *sourcemap.Map, bool) {
+	if transformer.Checked != nil {
+		output, transformed := transformer.Checked(path, content)
+		return output, nil, transformed
+	}
+
+	output, outputMap := transformer.Transform(path, content)
+	return output, outputMap, true
+}
+
+// registeredTransformers all transformers, in registration order
+var registeredTransformers = []Transformer{}
+
+// AddTransformer registers a transformer for its extensions
+func AddTransformer(transformer Transformer) {
+	registeredTransformers = append(registeredTransformers, transformer)
+}
+
+// TransformersOf the transformers of an extension in priority order
+func TransformersOf(extension string) []Transformer {
+	transformers := []Transformer{}
+
+	for _, transformer := range registeredTransformers {
+		for _, transformerExtension := range transformer.Extensions {
+			if transformerExtension == extension {
+				transformers = append(transformers, transformer)
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(transformers, func(a, b int) bool {
+		return transformers[a].Priority < transformers[b].Priority
+	})
+
+	return transformers
+}
+
+// PipelineOf the transformers applied to a file. Without options.Pipelines
+// every transformer of the extension runs, otherwise the first pipeline
+// matching the file decides and files matching none are left untouched.
+// Transformers of a pipeline run in the listed order, skipping those that
+// do not handle the extension
+func PipelineOf(extension string, file string) []Transformer {
+	transformers := TransformersOf(extension)
+	if len(options.Pipelines) == 0 {
+		return transformers
+	}
+
+	relative, err := filepath.Rel(options.PublicRoot, file)
+	if err != nil {
+		relative = file
+	}
+	relative = filepath.ToSlash(relative)
+
+	for _, pipeline := range options.Pipelines {
+		if !MatchGlob(pipeline.Match, relative) {
+			continue
+		}
+
+		selected := []Transformer{}
+		for _, name := range pipeline.Transformers {
+			if name == AllTransformers {
+				selected = append(selected, transformers...)
+				continue
+			}
+
+			for _, transformer := range transformers {
+				if transformer.Name == name {
+					selected = append(selected, transformer)
+					break
+				}
+			}
+		}
+
+		return selected
+	}
+
+	return []Transformer{}
+}
+
+// CheckPipelines warns about pipelines using transformers that are not
+// registered, to be called once every transformer is registered
+func CheckPipelines() {
+	for _, pipeline := range options.Pipelines {
+		for _, name := range pipeline.Transformers {
+			if name != AllTransformers && !isRegistered(name) {
+				fmt.Println("Pipeline", pipeline.Match, "uses the unknown transformer", name)
+			}
+		}
+	}
+}
+
+// isRegistered a transformer with that name exists, for any extension
+func isRegistered(name string) bool {
+	for _, transformer := range registeredTransformers {
+		if transformer.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchGlob the slash separated name matches the glob, "**" matches any
+// amount of folders and other segments follow path.Match. Globs without "/"
+// are matched against the file name
+func MatchGlob(glob string, name string) bool {
+	if !strings.Contains(glob, "/") {
+		matches, _ := path.Match(glob, path.Base(name))
+		return matches
+	}
+
+	return matchSegments(
+		strings.Split(strings.Trim(glob, "/"), "/"),
+		strings.Split(strings.Trim(name, "/"), "/"),
+	)
+}
+
+func matchSegments(glob []string, name []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for skipped := 0; skipped <= len(name); skipped++ {
+				if matchSegments(glob[1:], name[skipped:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if matches, _ := path.Match(glob[0], name[0]); !matches {
+			return false
+		}
+
+		glob, name = glob[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
@@ -1,66 +1,399 @@
 package require
 
 import (
-	"regexp"
+	"strconv"
+	"strings"
 
+	"github.com/nonanick/impatience/diagnostics"
 	"github.com/nonanick/impatience/transform"
+	"github.com/nonanick/impatience/transform/jsscan"
+	"github.com/nonanick/impatience/transform/moduleexports"
 )
 
+// Name of the transformer in pipelines
+const Name = "require"
+
 // Register this file transformer to all .js files
 // require will change "require()" from js scripts
-// to import syntax, maybe i should just inject
-// a request polyfill cause module.exports is another
-// pain to transform
+// to import syntax, CommonJS modules are left to
+// the module exports interop
 func Register() {
-	transform.AddFileTransformer(".js", RequireTransform)
+	transform.AddTransformer(transform.Transformer{
+		Name:       Name,
+		Extensions: []string{".js"},
+		Priority:   transform.PriorityModules,
+		Transform:  transform.Plain(RequireTransform),
+	})
 }
 
-// RequireRegExp regular expression used to find require statements in js syntax
-var RequireRegExp = regexp.MustCompile(
-	"const\\s*(?P<name>.*)\\s*=\\s*require\\(\\s*(?P<path>\".*\"|'.*')\\s*\\)(?:;?)",
-)
+// edit replaces content[start:end] by text
+type edit struct {
+	start int
+	end   int
+	text  string
+}
+
+// requiredModule how a required specifier is imported
+type requiredModule struct {
+	specifier string
+	// binding holding the module value, for require calls kept as expressions
+	binding string
+	// asValue some require call is kept as an expression
+	asValue bool
+	// named imports coming from destructured declarations
+	named []string
+}
 
-// RequireTransform function that analyzes
+// RequireTransform converts the top level require calls using a string
+// literal into imports. Destructuring declarations become named imports and
+// bare require statements side effect imports, any other require call is
+// replaced by the module value imported at the top of the file. Require
+// calls that may not run (in functions, blocks or conditions) are left
+// untouched with a diagnostic
 var RequireTransform transform.FileTransformer = func(
 	path string,
 	content []byte,
 ) []byte {
 
-	matcher := RequireRegExp
+	// CommonJS modules are wrapped by the interop transformer, their require
+	// calls are resolved there
+	if moduleexports.IsCommonJS(content) {
+		return content
+	}
+
+	tokens := jsscan.Tokenize(content)
+
+	if !usesRequire(tokens) || definesRequire(tokens) {
+		return content
+	}
+
+	modules := []*requiredModule{}
+	known := map[string]*requiredModule{}
+	moduleOf := func(specifier string) *requiredModule {
+		if known[specifier] == nil {
+			known[specifier] = &requiredModule{
+				specifier: specifier,
+				binding:   "__require_" + strconv.Itoa(len(modules)),
+			}
+			modules = append(modules, known[specifier])
+		}
+		return known[specifier]
+	}
+
+	edits := []edit{}
+
+	for index := range tokens {
+		if !isRequire(tokens, index) {
+			continue
+		}
+
+		next := tokens[index+1]
+
+		if !next.Is("(") {
+			if next.Is(".") {
+				diagnostics.Warnf(
+					"Require Transform", path,
+					"require%s at offset %d has no browser equivalent and was left untouched",
+					memberName(tokens, index), tokens[index].Start,
+				)
+			}
+			continue
+		}
+
+		specifier, isLiteral := "", false
+		if index+3 < len(tokens) && tokens[index+3].Is(")") {
+			specifier, isLiteral = tokens[index+2].Value()
+		}
+
+		if !isLiteral {
+			diagnostics.Warnf(
+				"Require Transform", path,
+				"require call at offset %d does not use a string literal and can't be converted to an import",
+				tokens[index].Start,
+			)
+			continue
+		}
+
+		// Imports always run, hoisting a require that may not would break the
+		// module when the required file is missing or meant for node
+		if isConditional(tokens, index) {
+			diagnostics.Warnf(
+				"Require Transform", path,
+				"require(%s) at offset %d is nested or conditional, it can't be hoisted to an import and was left untouched",
+				jsscan.Quote(specifier), tokens[index].Start,
+			)
+			continue
+		}
+
+		module := moduleOf(specifier)
+		call := edit{start: tokens[index].Start, end: tokens[index+3].End}
+
+		// const { a, b: c } = require("y");
+		if declaration, imports, ok := destructuredDeclaration(tokens, index); ok {
+			module.named = append(module.named, imports...)
+			edits = append(edits, declaration)
+			continue
+		}
+
+		// require("side-effect");
+		if statement, ok := bareStatement(tokens, index); ok {
+			edits = append(edits, statement)
+			continue
+		}
 
-	// Find all submatches using this matcher
-	matches := matcher.FindAllSubmatch(content, -1)
-	matchesIndex := matcher.FindAllIndex(content, -1)
-	subNames := matcher.SubexpNames()
+		module.asValue = true
+		call.text = module.binding
+		edits = append(edits, call)
+	}
 
-	if matches == nil {
+	if len(modules) == 0 {
 		return content
 	}
 
-	// all transformation will be done in this
-	newContent := []byte{}
+	var transformed strings.Builder
+	transformed.WriteString(imports(modules))
+
 	lastIndex := 0
+	for _, replacement := range edits {
+		transformed.Write(content[lastIndex:replacement.start])
+		transformed.WriteString(replacement.text)
+		lastIndex = replacement.end
+	}
+	transformed.Write(content[lastIndex:])
 
-	// Find all matches -- First one is the whole match!
-	for ioSubMatch, subMatches := range matches {
+	return []byte(transformed.String())
+}
 
-		if len(subMatches) > 0 {
-			name := subMatches[IndexOf("name", subNames)]
-			path := subMatches[IndexOf("path", subNames)]
+// imports declarations replacing the require calls, one per line
+func imports(modules []*requiredModule) string {
+	var declarations strings.Builder
 
-			startOfMatch := matchesIndex[ioSubMatch][0]
-			endOfMatch := matchesIndex[ioSubMatch][1]
+	for _, module := range modules {
+		specifier := jsscan.Quote(module.specifier)
 
-			newContent = append(newContent, content[lastIndex:startOfMatch]...)
-			newContent = append(newContent, []byte("import "+string(name)+" from "+string(path)+";")...)
-			lastIndex = endOfMatch
+		if len(module.named) > 0 {
+			declarations.WriteString(
+				"import { " + strings.Join(module.named, ", ") + " } from " + specifier + ";\n",
+			)
+		}
 
+		if module.asValue {
+			namespace := module.binding + "_module"
+			declarations.WriteString("import * as " + namespace + " from " + specifier + ";\n")
+			// Modules wrapped by the CommonJS interop expose module.exports
+			declarations.WriteString(
+				"var " + module.binding + " = \"__cjsExports\" in " + namespace + " ? " +
+					namespace + ".__cjsExports : " + namespace + ";\n",
+			)
+		}
+
+		if len(module.named) == 0 && !module.asValue {
+			declarations.WriteString("import " + specifier + ";\n")
 		}
 	}
 
-	newContent = append(newContent, content[lastIndex:]...)
+	return declarations.String()
+}
+
+// destructuredDeclaration matches a top level "const { a, b: c } = require(...)"
+// declaration and return the named imports replacing it
+func destructuredDeclaration(tokens []jsscan.Token, index int) (edit, []string, bool) {
+	if tokens[index].Depth != 0 || index < 4 || !tokens[index-1].Is("=") ||
+		!tokens[index-2].Is("}") {
+		return edit{}, nil, false
+	}
 
-	return newContent
+	open := index - 3
+	for open > 0 && !(tokens[open].Is("{") && tokens[open].Depth == 0) {
+		open--
+	}
+
+	if open < 1 || !tokens[open-1].Is("const") || open > 1 && tokens[open-2].Is("export") {
+		return edit{}, nil, false
+	}
+
+	imports := []string{}
+	for position := open + 1; position < index-2; {
+		key := tokens[position]
+		if key.Kind != jsscan.Identifier {
+			return edit{}, nil, false
+		}
+
+		binding := key
+		position++
+
+		if tokens[position].Is(":") {
+			binding = tokens[position+1]
+			if binding.Kind != jsscan.Identifier || !jsscan.IsIdentifier(binding.Text) {
+				return edit{}, nil, false
+			}
+			position += 2
+		} else if !jsscan.IsIdentifier(key.Text) {
+			return edit{}, nil, false
+		}
+
+		if binding.Text == key.Text {
+			imports = append(imports, key.Text)
+		} else {
+			imports = append(imports, key.Text+" as "+binding.Text)
+		}
+
+		if position < index-2 {
+			if !tokens[position].Is(",") {
+				return edit{}, nil, false
+			}
+			position++
+		}
+	}
+
+	end, ok := statementEnd(tokens, index+3)
+	if !ok || len(imports) == 0 {
+		return edit{}, nil, false
+	}
+
+	return edit{start: tokens[open-1].Start, end: end}, imports, true
+}
+
+// bareStatement matches a top level require call used as a statement
+func bareStatement(tokens []jsscan.Token, index int) (edit, bool) {
+	if tokens[index].Depth != 0 {
+		return edit{}, false
+	}
+
+	if index > 0 {
+		previous := tokens[index-1]
+		startsStatement := previous.Is(";") || previous.Is("}") ||
+			(tokens[index].NewlineBefore && previous.Kind != jsscan.Punctuator)
+		if !startsStatement {
+			return edit{}, false
+		}
+	}
+
+	end, ok := statementEnd(tokens, index+3)
+	if !ok {
+		return edit{}, false
+	}
+
+	return edit{start: tokens[index].Start, end: end}, true
+}
+
+// isConditional the require call may not run when the module is evaluated:
+// it is nested (functions, blocks, arguments) or follows a condition in its
+// statement
+func isConditional(tokens []jsscan.Token, index int) bool {
+	if tokens[index].Depth != 0 {
+		return true
+	}
+
+	for position := index - 1; position >= 0; position-- {
+		token := tokens[position]
+		if token.Depth != 0 {
+			continue
+		}
+
+		if token.Is(";") || token.Is("}") {
+			return false
+		}
+
+		for _, condition := range []string{"?", "&&", "||", "??", "=>", "if", "else", "while", "for", "do"} {
+			if token.Is(condition) {
+				return true
+			}
+		}
+
+		// A line break after anything but a punctuator starts a statement
+		if token.NewlineBefore && position > 0 && tokens[position-1].Kind != jsscan.Punctuator {
+			return false
+		}
+	}
+
+	return false
+}
+
+// statementEnd checks if the statement ends after the token at index and
+// return the offset where it ends, including its semicolon
+func statementEnd(tokens []jsscan.Token, index int) (int, bool) {
+	if index+1 >= len(tokens) {
+		return tokens[index].End, true
+	}
+
+	next := tokens[index+1]
+
+	if next.Is(";") {
+		return next.End, true
+	}
+
+	if next.NewlineBefore && (next.Kind == jsscan.Identifier || next.Is("}")) {
+		return tokens[index].End, true
+	}
+
+	return 0, false
+}
+
+// usesRequire any "require" identifier that is not a property
+func usesRequire(tokens []jsscan.Token) bool {
+	for index := range tokens {
+		if isRequire(tokens, index) {
+			return true
+		}
+	}
+	return false
+}
+
+// definesRequire the file declares or assigns its own require, converting
+// its calls would change their meaning
+func definesRequire(tokens []jsscan.Token) bool {
+	for index, token := range tokens {
+		if !token.Is("require") || index == 0 {
+			continue
+		}
+
+		previous := tokens[index-1]
+		if previous.Is("function") || previous.Is("var") || previous.Is("let") ||
+			previous.Is("const") {
+			return true
+		}
+
+		if index+1 >= len(tokens) {
+			continue
+		}
+
+		next := tokens[index+1]
+		if next.Is("=") {
+			return true
+		}
+
+		// Parameters named require, or require handed to another function
+		if (previous.Is("(") || previous.Is(",")) && (next.Is(")") || next.Is(",")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isRequire the token is the global require, followed by something
+func isRequire(tokens []jsscan.Token, index int) bool {
+	if !tokens[index].Is("require") || index+1 >= len(tokens) {
+		return false
+	}
+
+	if index > 0 && (tokens[index-1].Is(".") || tokens[index-1].Is("?.")) {
+		return false
+	}
+
+	// Object keys and shorthand methods named require
+	if tokens[index+1].Is(":") {
+		return false
+	}
+
+	return true
+}
+
+func memberName(tokens []jsscan.Token, index int) string {
+	if index+2 < len(tokens) {
+		return "." + tokens[index+2].Text
+	}
+	return ""
 }
 
 // IndexOf index of a string in an array
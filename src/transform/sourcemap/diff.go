@@ -0,0 +1,166 @@
+package sourcemap
+
+import (
+	"strings"
+)
+
+// MaxDiffEdits lines added or removed by a transformer above which Diff
+// stops looking for the moved lines and only keeps the unchanged start and
+// end of the file
+var MaxDiffEdits = 1000
+
+// Diff line map between a content and its transformation, used for
+// transformers that do not produce a map. Unchanged lines keep their
+// columns, changed lines map to the start of the line they replace and
+// inserted lines are left unmapped
+func Diff(original []byte, transformed []byte) *Map {
+	originalLines := strings.Split(string(original), "\n")
+	transformedLines := strings.Split(string(transformed), "\n")
+
+	pairs := matchLines(originalLines, transformedLines)
+
+	lines := make([][]Segment, len(transformedLines))
+	previousOriginal, previousTransformed := -1, -1
+
+	// A sentinel pair closes the last gap
+	pairs = append(pairs, [2]int{len(originalLines), len(transformedLines)})
+
+	for _, pair := range pairs {
+		replaced := pair[0] - previousOriginal - 1
+
+		for line := previousTransformed + 1; line < pair[1]; line++ {
+			if replaced <= 0 {
+				lines[line] = []Segment{}
+				continue
+			}
+
+			originalLine := previousOriginal + 1 + line - previousTransformed - 1
+			if originalLine >= pair[0] {
+				originalLine = pair[0] - 1
+			}
+			lines[line] = []Segment{{Column: 0, Source: 0, OriginalLine: originalLine, Name: -1}}
+		}
+
+		if pair[1] < len(transformedLines) {
+			lines[pair[1]] = []Segment{{Column: 0, Source: 0, OriginalLine: pair[0], Name: -1}}
+		}
+
+		previousOriginal, previousTransformed = pair[0], pair[1]
+	}
+
+	sourceMap := &Map{Version: 3, Sources: []string{""}, Names: []string{}}
+	sourceMap.SetLines(lines)
+	return sourceMap
+}
+
+// matchLines pairs the identical lines of a and b in order, using a shortest
+// edit script (Myers) between the common start and end of both
+func matchLines(a []string, b []string) [][2]int {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix &&
+		a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	pairs := [][2]int{}
+	for line := 0; line < prefix; line++ {
+		pairs = append(pairs, [2]int{line, line})
+	}
+
+	middleA, middleB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	for _, pair := range shortestEdit(middleA, middleB, MaxDiffEdits) {
+		pairs = append(pairs, [2]int{pair[0] + prefix, pair[1] + prefix})
+	}
+
+	for line := suffix; line > 0; line-- {
+		pairs = append(pairs, [2]int{len(a) - line, len(b) - line})
+	}
+
+	return pairs
+}
+
+// shortestEdit identical lines kept by the shortest edit script turning a
+// into b, none when the script needs more than maxEdits
+func shortestEdit(a []string, b []string, maxEdits int) [][2]int {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return [][2]int{}
+	}
+
+	limit := n + m
+	if limit > maxEdits {
+		limit = maxEdits
+	}
+
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	trace := [][]int{}
+
+	for d := 0; d <= limit; d++ {
+		snapshot := make([]int, 2*d+3)
+		copy(snapshot, v[offset-d-1:offset+d+2])
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			x := 0
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrack(trace, n, m)
+			}
+		}
+	}
+
+	return [][2]int{}
+}
+
+// backtrack walks the trace of shortestEdit back from the end, collecting
+// the diagonal moves
+func backtrack(trace [][]int, n int, m int) [][2]int {
+	pairs := [][2]int{}
+	x, y := n, m
+
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		at := func(k int) int { return v[k+d+1] }
+
+		k := x - y
+		previousK := k - 1
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			previousK = k + 1
+		}
+
+		previousX := at(previousK)
+		previousY := previousX - previousK
+
+		for x > previousX && y > previousY {
+			x--
+			y--
+			pairs = append(pairs, [2]int{x, y})
+		}
+
+		x, y = previousX, previousY
+	}
+
+	for left, right := 0, len(pairs)-1; left < right; left, right = left+1, right-1 {
+		pairs[left], pairs[right] = pairs[right], pairs[left]
+	}
+
+	return pairs
+}
@@ -0,0 +1,319 @@
+// Package sourcemap reads, composes and writes source maps (revision 3), so
+// the transformers chained on a file produce a single map back to the file
+package sourcemap
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Map source map, mappings are kept encoded as in the json
+type Map struct {
+	Version        int      `json:"version"`
+	File           string   `json:"file,omitempty"`
+	SourceRoot     string   `json:"sourceRoot,omitempty"`
+	Sources        []string `json:"sources"`
+	SourcesContent []string `json:"sourcesContent,omitempty"`
+	Names          []string `json:"names"`
+	Mappings       string   `json:"mappings"`
+}
+
+// Segment maps a generated column to a position of a source, a Source of
+// -1 leaves the column unmapped and a Name of -1 has no name
+type Segment struct {
+	Column int
+
+	Source         int
+	OriginalLine   int
+	OriginalColumn int
+	Name           int
+}
+
+// Parse decodes a json source map
+func Parse(content []byte) (*Map, error) {
+	sourceMap := &Map{}
+	if err := json.Unmarshal(content, sourceMap); err != nil {
+		return nil, errors.New("Invalid source map: " + err.Error())
+	}
+
+	if sourceMap.Version != 3 {
+		return nil, errors.New("Unsupported source map version")
+	}
+
+	return sourceMap, nil
+}
+
+// Encode the map as json
+func (sourceMap *Map) Encode() []byte {
+	encoded, err := json.Marshal(sourceMap)
+	if err != nil {
+		return []byte{}
+	}
+	return encoded
+}
+
+// Lines decodes the mappings, one list of segments per generated line
+func (sourceMap *Map) Lines() ([][]Segment, error) {
+	lines := [][]Segment{}
+	source, originalLine, originalColumn, name := 0, 0, 0, 0
+
+	for _, line := range strings.Split(sourceMap.Mappings, ";") {
+		segments := []Segment{}
+		column := 0
+
+		for _, field := range strings.Split(line, ",") {
+			if field == "" {
+				continue
+			}
+
+			values, err := decodeVLQ(field)
+			if err != nil {
+				return nil, err
+			}
+
+			column += values[0]
+			segment := Segment{Column: column, Source: -1, Name: -1}
+
+			if len(values) >= 4 {
+				source += values[1]
+				originalLine += values[2]
+				originalColumn += values[3]
+				segment.Source, segment.OriginalLine, segment.OriginalColumn = source, originalLine, originalColumn
+			}
+
+			if len(values) >= 5 {
+				name += values[4]
+				segment.Name = name
+			}
+
+			segments = append(segments, segment)
+		}
+
+		sort.SliceStable(segments, func(a, b int) bool {
+			return segments[a].Column < segments[b].Column
+		})
+		lines = append(lines, segments)
+	}
+
+	return lines, nil
+}
+
+// SetLines encodes the segments of each generated line as the mappings
+func (sourceMap *Map) SetLines(lines [][]Segment) {
+	var mappings strings.Builder
+	source, originalLine, originalColumn, name := 0, 0, 0, 0
+
+	for index, segments := range lines {
+		if index > 0 {
+			mappings.WriteByte(';')
+		}
+
+		column := 0
+		for position, segment := range segments {
+			if position > 0 {
+				mappings.WriteByte(',')
+			}
+
+			values := []int{segment.Column - column}
+			column = segment.Column
+
+			if segment.Source >= 0 {
+				values = append(values,
+					segment.Source-source,
+					segment.OriginalLine-originalLine,
+					segment.OriginalColumn-originalColumn,
+				)
+				source, originalLine, originalColumn = segment.Source, segment.OriginalLine, segment.OriginalColumn
+
+				if segment.Name >= 0 {
+					values = append(values, segment.Name-name)
+					name = segment.Name
+				}
+			}
+
+			mappings.WriteString(encodeVLQ(values))
+		}
+	}
+
+	sourceMap.Mappings = mappings.String()
+}
+
+// Compose maps the output of later back to the sources of earlier, later
+// must map to the file earlier generated. Segments of earlier found in the
+// spans copied by later are kept, so a coarse later map does not lose the
+// precision of earlier. A nil earlier map returns later
+func Compose(later *Map, earlier *Map) (*Map, error) {
+	if earlier == nil {
+		return later, nil
+	}
+
+	laterLines, err := later.Lines()
+	if err != nil {
+		return nil, err
+	}
+
+	earlierLines, err := earlier.Lines()
+	if err != nil {
+		return nil, err
+	}
+
+	composed := &Map{
+		Version:        3,
+		File:           later.File,
+		Sources:        earlier.Sources,
+		SourcesContent: earlier.SourcesContent,
+		Names:          earlier.Names,
+	}
+
+	lines := make([][]Segment, len(laterLines))
+
+	for index, segments := range laterLines {
+		composedSegments := []Segment{}
+
+		for position, segment := range segments {
+			if segment.Source < 0 || segment.OriginalLine >= len(earlierLines) {
+				composedSegments = append(composedSegments, Segment{Column: segment.Column, Source: -1, Name: -1})
+				continue
+			}
+
+			// The span of later ends at its next segment
+			spanEnd := -1
+			if position+1 < len(segments) {
+				spanEnd = segments[position+1].Column - segment.Column
+			}
+
+			earlierSegments := earlierLines[segment.OriginalLine]
+			offset := segment.Column - segment.OriginalColumn
+
+			covering := -1
+			for candidate, earlierSegment := range earlierSegments {
+				if earlierSegment.Column > segment.OriginalColumn {
+					break
+				}
+				covering = candidate
+			}
+
+			if covering >= 0 {
+				mapped := earlierSegments[covering]
+				mapped.Column = segment.Column
+				composedSegments = append(composedSegments, mapped)
+			} else {
+				composedSegments = append(composedSegments, Segment{Column: segment.Column, Source: -1, Name: -1})
+			}
+
+			for _, earlierSegment := range earlierSegments[covering+1:] {
+				relative := earlierSegment.Column - segment.OriginalColumn
+				if spanEnd >= 0 && relative >= spanEnd {
+					break
+				}
+
+				moved := earlierSegment
+				moved.Column += offset
+				composedSegments = append(composedSegments, moved)
+			}
+		}
+
+		lines[index] = composedSegments
+	}
+
+	composed.SetLines(lines)
+	return composed, nil
+}
+
+// inlineMarker start of an inline source map comment
+var inlineMarker = []byte("//# sourceMappingURL=data:application/json;")
+
+// ExtractInline removes the inline source map comment at the end of the
+// content and return the decoded map, nil when there is none
+func ExtractInline(content []byte) ([]byte, *Map) {
+	start := bytes.LastIndex(content, inlineMarker)
+	if start < 0 {
+		return content, nil
+	}
+
+	comment := string(bytes.TrimSpace(content[start+len(inlineMarker):]))
+	if strings.ContainsAny(comment, "\n") {
+		return content, nil
+	}
+
+	dataStart := strings.Index(comment, "base64,")
+	if dataStart < 0 {
+		return content, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(comment[dataStart+len("base64,"):])
+	if err != nil {
+		return content, nil
+	}
+
+	sourceMap, err := Parse(decoded)
+	if err != nil {
+		return content, nil
+	}
+
+	return bytes.TrimRight(content[:start], " \t\r\n"), sourceMap
+}
+
+const base64Digits = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// decodeVLQ decodes the base64 VLQ values of a segment
+func decodeVLQ(field string) ([]int, error) {
+	values := []int{}
+	value, shift := 0, uint(0)
+
+	for index := 0; index < len(field); index++ {
+		digit := strings.IndexByte(base64Digits, field[index])
+		if digit < 0 {
+			return nil, errors.New("Invalid source map mappings: " + field)
+		}
+
+		value += (digit & 31) << shift
+		if digit&32 != 0 {
+			shift += 5
+			continue
+		}
+
+		if value&1 != 0 {
+			values = append(values, -(value >> 1))
+		} else {
+			values = append(values, value>>1)
+		}
+		value, shift = 0, 0
+	}
+
+	if shift != 0 || len(values) == 0 {
+		return nil, errors.New("Invalid source map mappings: " + field)
+	}
+
+	return values, nil
+}
+
+// encodeVLQ encodes the values of a segment as base64 VLQ
+func encodeVLQ(values []int) string {
+	var encoded strings.Builder
+
+	for _, value := range values {
+		vlq := value << 1
+		if value < 0 {
+			vlq = (-value << 1) | 1
+		}
+
+		for {
+			digit := vlq & 31
+			vlq >>= 5
+			if vlq > 0 {
+				digit |= 32
+			}
+			encoded.WriteByte(base64Digits[digit])
+			if vlq == 0 {
+				break
+			}
+		}
+	}
+
+	return encoded.String()
+}
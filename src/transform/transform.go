@@ -1,24 +1,40 @@
 package transform
 
 import (
+	"bytes"
+	"fmt"
 	"io/ioutil"
+	"mime"
 	"path/filepath"
 
 	"github.com/kr/pretty"
+	"github.com/nonanick/impatience/diagnostics"
+	"github.com/nonanick/impatience/transform/diskcache"
+	"github.com/nonanick/impatience/transform/sourcemap"
 )
 
-var registeredTransformers = map[string][]FileTransformer{}
+var declaredOutputs = map[string]Output{}
+
+// declaredExtensions extensions with a declared output, in declaration order
+var declaredExtensions = []string{}
 
 // HasFileTransformer Check if the file has an associated transformer
-// the file extension is used to determine if the file actually has
-// a transformer associated with it
+// the file extension and the configured pipelines are used to determine if
+// the file actually has a transformer associated with it
 func HasFileTransformer(filePath string) bool {
 	extension := filepath.Ext(filePath)
-	return len(registeredTransformers[extension]) > 0
+	return len(PipelineOf(extension, filePath)) > 0
 }
 
 // Transform a file applying all transformations inside it
 func Transform(file string) []byte {
+	content, _ := TransformWithMap(file)
+	return content
+}
+
+// TransformWithMap same as Transform, also returning the source map of the
+// transformed content, nil when no transformer changed the file
+func TransformWithMap(file string) ([]byte, *sourcemap.Map) {
 
 	ext := filepath.Ext(file)
 	content, err := ioutil.ReadFile(file)
@@ -26,10 +42,10 @@ func Transform(file string) []byte {
 	if err != nil {
 		pretty.Println("Failed to transform file", file, " impatience could not read bytes from the original file!")
 
-		return []byte{}
+		return []byte{}, nil
 	}
 
-	return Apply(ext, file, content)
+	return ApplyWithMap(ext, file, content)
 
 }
 
@@ -37,31 +53,224 @@ func Transform(file string) []byte {
 func Apply(
 	extension string,
 	path string,
-	bytes []byte,
+	content []byte,
 ) []byte {
+	transformed, _ := ApplyWithMap(extension, path, content)
+	return transformed
+}
+
+// ApplyWithMap apply the pipeline of the file (see PipelineOf) and
+// compose their source maps into one map to the original content. Inline
+// maps left by a transformer are removed from its output and used as its
+// map, transformers without any map get the line map of their changes
+func ApplyWithMap(
+	extension string,
+	path string,
+	content []byte,
+) ([]byte, *sourcemap.Map) {
+
+	var composed *sourcemap.Map
+	transformed := content
+
+	for _, transformer := range PipelineOf(extension, path) {
+		output, outputMap := run(transformer, path, transformed)
 
-	if len(registeredTransformers[extension]) > 0 {
-		var newBytes = bytes
+		output, inlineMap := sourcemap.ExtractInline(output)
+		if outputMap == nil {
+			outputMap = inlineMap
+		}
+
+		if outputMap == nil {
+			if bytes.Equal(output, transformed) {
+				continue
+			}
+			outputMap = sourcemap.Diff(transformed, output)
+		}
 
-		for _, transformer := range registeredTransformers[extension] {
-			newBytes = transformer(path, newBytes)
+		var err error
+		composed, err = sourcemap.Compose(outputMap, composed)
+		if err != nil {
+			pretty.Println("Could not compose the source map of", path, err.Error())
+			composed = sourcemap.Diff(content, output)
 		}
 
-		bytes = newBytes
+		transformed = output
+	}
+
+	if composed != nil {
+		composed.File = filepath.Base(path)
+		composed.SourceRoot = ""
+		composed.Sources = []string{filepath.Base(path)}
+		composed.SourcesContent = []string{string(content)}
 	}
 
-	return bytes
+	return transformed, composed
 
 }
 
-// AddFileTransformer adds a file transformer to an extension
+// run applies a transformer, cacheable transformers reuse the output kept
+// in the disk cache for the same file, content and configuration. Outputs
+// of transformers reporting errors or not transforming the content are not
+// cached
+func run(transformer Transformer, path string, content []byte) ([]byte, *sourcemap.Map) {
+	if transformer.Version == "" || !diskcache.Enabled() {
+		output, outputMap, _ := transformer.apply(path, content)
+		return output, outputMap
+	}
+
+	config := ""
+	if transformer.Config != nil {
+		config = transformer.Config()
+	}
+
+	key := diskcache.Key(
+		[]byte(transformer.Name),
+		[]byte(transformer.Version),
+		[]byte(config),
+		[]byte(path),
+		content,
+	)
+
+	if entry, cached := diskcache.Get(key); cached {
+		for _, diagnostic := range entry.Diagnostics {
+			diagnostics.Report(diagnostic)
+		}
+
+		var sourceMap *sourcemap.Map
+		if len(entry.SourceMap) > 0 {
+			sourceMap, _ = sourcemap.Parse(entry.SourceMap)
+		}
+		return entry.Content, sourceMap
+	}
+
+	reportedBefore := len(diagnostics.For(path))
+	output, outputMap, transformed := transformer.apply(path, content)
+	reported := diagnostics.For(path)[reportedBefore:]
+
+	if !transformed {
+		return output, outputMap
+	}
+
+	for _, diagnostic := range reported {
+		if diagnostic.Severity == diagnostics.Error {
+			return output, outputMap
+		}
+	}
+
+	entry := diskcache.Entry{Content: output, Diagnostics: reported}
+	if outputMap != nil {
+		entry.SourceMap = outputMap.Encode()
+	}
+	diskcache.Put(key, entry)
+
+	return output, outputMap
+}
+
+// AddFileTransformer adds an unnamed file transformer to an extension, it
+// runs with the DefaultPriority
 func AddFileTransformer(
 	extension string,
 	transformer FileTransformer,
 ) {
-	registeredTransformers[extension] = append(registeredTransformers[extension], transformer)
+	AddMappedFileTransformer(extension, Plain(transformer))
+}
+
+// AddMappedFileTransformer adds an unnamed file transformer returning the
+// source map of its output to an extension
+func AddMappedFileTransformer(
+	extension string,
+	transformer MappedFileTransformer,
+) {
+	AddTransformer(Transformer{
+		Extensions: []string{extension},
+		Priority:   DefaultPriority,
+		Transform:  transformer,
+	})
+}
+
+// Plain adapts a FileTransformer, its source map is built from its changes
+func Plain(transformer FileTransformer) MappedFileTransformer {
+	return func(path string, content []byte) ([]byte, *sourcemap.Map) {
+		return transformer(path, content), nil
+	}
+}
+
+// DeclareOutput declares what the transformers of an extension produce,
+// an empty output extension keeps the original one and an empty mime type
+// is deduced from the output extension
+func DeclareOutput(
+	extension string,
+	outputExtension string,
+	mimeType string,
+) {
+	if outputExtension == "" {
+		outputExtension = extension
+	}
+
+	if mimeType == "" {
+		mimeType = mime.TypeByExtension(outputExtension)
+	}
+
+	if mimeType != "" {
+		if err := mime.AddExtensionType(extension, mimeType); err != nil {
+			fmt.Println("Could not register mime type", mimeType, "for extension", extension, err)
+		}
+	}
+
+	if _, declared := declaredOutputs[extension]; !declared {
+		declaredExtensions = append(declaredExtensions, extension)
+	}
+
+	declaredOutputs[extension] = Output{
+		Extension: outputExtension,
+		MimeType:  mimeType,
+	}
+}
+
+// OutputOf return the declared output of an extension, extensions that did
+// not declare an output are served as they are
+func OutputOf(extension string) Output {
+	if output, declared := declaredOutputs[extension]; declared {
+		return output
+	}
+
+	return Output{
+		Extension: extension,
+		MimeType:  mime.TypeByExtension(extension),
+	}
+}
+
+// SourceExtensions return the extensions transformed into the output
+// extension, in the order they were declared. The output extension itself
+// is not included
+func SourceExtensions(outputExtension string) []string {
+	sources := []string{}
+
+	for _, extension := range declaredExtensions {
+		if extension != outputExtension &&
+			declaredOutputs[extension].Extension == outputExtension {
+			sources = append(sources, extension)
+		}
+	}
+
+	return sources
+}
+
+// Output extension and mime type of transformed content
+type Output struct {
+	Extension string
+	MimeType  string
 }
 
 // FileTransformer Function that "transforms" a file bytes
 // it should modify the bytes and return
 type FileTransformer = func(path string, content []byte) []byte
+
+// MappedFileTransformer FileTransformer that may also return the source map
+// from its output to its input, a nil map is built from the changes
+type MappedFileTransformer = func(path string, content []byte) ([]byte, *sourcemap.Map)
+
+// CheckedFileTransformer FileTransformer that also tells if its output is
+// the transformation of the content, an output that is not (the content
+// given back by a cancelled or failed run) is never kept in the disk cache
+type CheckedFileTransformer = func(path string, content []byte) ([]byte, bool)
@@ -0,0 +1,82 @@
+package typescript
+
+import (
+	"github.com/nonanick/impatience/options"
+)
+
+// JSX runtimes
+const (
+	// JSXAutomatic imports the jsx functions from "<import source>/jsx-runtime"
+	JSXAutomatic = "automatic"
+	// JSXClassic calls the configured factory/fragment, which must be in scope
+	JSXClassic = "classic"
+)
+
+// JSXConfig how JSX is compiled to javascript
+type JSXConfig struct {
+	Runtime      string
+	ImportSource string
+	Factory      string
+	Fragment     string
+}
+
+// CurrentJSX resolves the JSX configuration, Impatience options take
+// precedence over the tsconfig ones
+func CurrentJSX() JSXConfig {
+	compilerOptions := CompilerOptions()
+
+	config := JSXConfig{
+		Runtime:      JSXAutomatic,
+		ImportSource: "react",
+		Factory:      "React.createElement",
+		Fragment:     "React.Fragment",
+	}
+
+	switch compilerOptions["jsx"] {
+	case "react":
+		config.Runtime = JSXClassic
+	case "react-jsx", "react-jsxdev":
+		config.Runtime = JSXAutomatic
+	}
+
+	overrideWith(&config.ImportSource, compilerOptions["jsxImportSource"])
+	overrideWith(&config.Factory, compilerOptions["jsxFactory"])
+	overrideWith(&config.Fragment, compilerOptions["jsxFragmentFactory"])
+
+	overrideWith(&config.Runtime, options.JSXRuntime)
+	overrideWith(&config.ImportSource, options.JSXImportSource)
+	overrideWith(&config.Factory, options.JSXFactory)
+	overrideWith(&config.Fragment, options.JSXFragment)
+
+	return config
+}
+
+// transpilerOptions tsconfig compiler options with the resolved JSX
+// configuration, the browser can't run "preserve"d JSX
+func transpilerOptions() map[string]interface{} {
+	compilerOptions := map[string]interface{}{}
+	for name, value := range CompilerOptions() {
+		compilerOptions[name] = value
+	}
+
+	jsx := CurrentJSX()
+	if jsx.Runtime == JSXClassic {
+		compilerOptions["jsx"] = "react"
+		compilerOptions["jsxFactory"] = jsx.Factory
+		compilerOptions["jsxFragmentFactory"] = jsx.Fragment
+		delete(compilerOptions, "jsxImportSource")
+	} else {
+		compilerOptions["jsx"] = "react-jsx"
+		compilerOptions["jsxImportSource"] = jsx.ImportSource
+		delete(compilerOptions, "jsxFactory")
+		delete(compilerOptions, "jsxFragmentFactory")
+	}
+
+	return compilerOptions
+}
+
+func overrideWith(target *string, value interface{}) {
+	if text, isText := value.(string); isText && text != "" {
+		*target = text
+	}
+}
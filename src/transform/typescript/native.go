@@ -0,0 +1,113 @@
+package typescript
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+	"github.com/nonanick/impatience/diagnostics"
+	"github.com/nonanick/impatience/transform/sourcemap"
+)
+
+// transpileNative transpiles the file inside the Impatience process, types
+// are stripped and the output is an ES module along with its source map.
+// Returns false and the error messages when the file could not be transpiled
+func transpileNative(path string, content []byte) ([]byte, *sourcemap.Map, []string, bool) {
+
+	compilerOptions := transpilerOptions()
+	jsx := CurrentJSX()
+
+	// esbuild picks the options it understands from the raw tsconfig
+	tsconfigRaw, err := json.Marshal(map[string]interface{}{
+		"compilerOptions": compilerOptions,
+	})
+	if err != nil {
+		return content, nil, []string{"could not encode compiler options: " + err.Error()}, false
+	}
+
+	transformOptions := api.TransformOptions{
+		Loader:      loaders[filepath.Ext(path)],
+		Format:      api.FormatESModule,
+		Target:      targetOf(compilerOptions["target"]),
+		Sourcemap:   api.SourceMapExternal,
+		Sourcefile:  path,
+		TsconfigRaw: string(tsconfigRaw),
+	}
+
+	if jsx.Runtime == JSXClassic {
+		transformOptions.JSX = api.JSXTransform
+		transformOptions.JSXFactory = jsx.Factory
+		transformOptions.JSXFragment = jsx.Fragment
+	} else {
+		transformOptions.JSX = api.JSXAutomatic
+		transformOptions.JSXImportSource = jsx.ImportSource
+	}
+
+	result := api.Transform(string(content), transformOptions)
+
+	for _, warning := range result.Warnings {
+		diagnostics.Warnf("Typescript", path, "%s", describeMessage(warning))
+	}
+
+	if len(result.Errors) > 0 {
+		messages := []string{}
+		for _, message := range result.Errors {
+			messages = append(messages, describeMessage(message))
+		}
+		return content, nil, messages, false
+	}
+
+	sourceMap, err := sourcemap.Parse(result.Map)
+	if err != nil {
+		diagnostics.Warnf("Typescript", path, "%s", err.Error())
+		sourceMap = nil
+	}
+
+	return result.Code, sourceMap, nil, true
+}
+
+// loaders esbuild loader of each transpiled extension
+var loaders = map[string]api.Loader{
+	".ts":  api.LoaderTS,
+	".tsx": api.LoaderTSX,
+	".jsx": api.LoaderJSX,
+}
+
+// esbuildTargets maps the tsconfig "target" to esbuild targets, es3 is
+// not supported by esbuild so it is handled as es5
+var esbuildTargets = map[string]api.Target{
+	"es3":    api.ES5,
+	"es5":    api.ES5,
+	"es6":    api.ES2015,
+	"es2015": api.ES2015,
+	"es2016": api.ES2016,
+	"es2017": api.ES2017,
+	"es2018": api.ES2018,
+	"es2019": api.ES2019,
+	"es2020": api.ES2020,
+	"es2021": api.ES2021,
+	"es2022": api.ES2022,
+	"es2023": api.ES2023,
+	"es2024": api.ES2024,
+	"esnext": api.ESNext,
+}
+
+func targetOf(target interface{}) api.Target {
+	name, _ := target.(string)
+	if esbuildTarget, known := esbuildTargets[strings.ToLower(name)]; known {
+		return esbuildTarget
+	}
+
+	return api.ES2015
+}
+
+// describeMessage formats an esbuild message with its location
+func describeMessage(message api.Message) string {
+	if message.Location == nil {
+		return message.Text
+	}
+
+	return fmt.Sprintf("%d:%d %s", message.Location.Line, message.Location.Column, message.Text)
+}
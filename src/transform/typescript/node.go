@@ -0,0 +1,117 @@
+package typescript
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nonanick/impatience/diagnostics"
+	"github.com/nonanick/impatience/options"
+	"github.com/nonanick/impatience/transform/worker"
+)
+
+// transpileWithNode sends the file to the node transpiler worker, the
+// 'typescript' package must be installed in the working directory
+func transpileWithNode(path string, content []byte) []byte {
+
+	ctx := context.Background()
+	if options.ExternalCommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.ExternalCommandTimeout)
+		defer cancel()
+	}
+
+	// The script is evaluated from the working directory, so 'typescript'
+	// is resolved from its node_modules without writing any file
+	transpiler := worker.GetArgs("typescript", []string{"node", "-e", transpilerScriptContent})
+	response, err := transpiler.Transform(ctx, path, content, transpilerOptions())
+	response.Report("Typescript", path)
+
+	if err != nil {
+		diagnostics.Errorf("Typescript", path, "Failed to obtain output from transpiler! %s", err.Error())
+		return content
+	}
+
+	fmt.Println("TS transpilation finished for file: ", path)
+	return []byte(response.Content)
+}
+
+var transpilerScriptContent = `
+const ts = require('typescript');
+const readline = require('readline');
+
+const defaultOptions = {
+	target : ts.ScriptTarget.ES2015,
+	esModuleInterop : true,
+	moduleResolution : ts.ModuleResolutionKind.NodeJs,
+	skipLibCheck : true,
+};
+
+// The browser needs ES modules and Impatience reads the inlined source
+// map, whatever the project tsconfig says
+const forcedOptions = {
+	module : ts.ModuleKind.ES2015,
+	inlineSourceMap : true,
+	sourceMap : false,
+	noEmit : false,
+	declaration : false,
+};
+
+// request.options holds the tsconfig "compilerOptions" as written in JSON
+const compilerOptions = (options) => Object.assign(
+	{},
+	defaultOptions,
+	ts.convertCompilerOptionsFromJson(options || {}, process.cwd()).options,
+	forcedOptions,
+);
+
+const reply = (message) => process.stdout.write(JSON.stringify(message) + '\n');
+
+const severity = (diagnostic) =>
+	diagnostic.category === ts.DiagnosticCategory.Error ? 'ERROR' : 'WARN';
+
+const transpile = (request) => {
+	const output = ts.transpileModule(request.content, {
+		fileName : request.path,
+		compilerOptions : compilerOptions(request.options),
+		reportDiagnostics : true,
+	});
+
+	return {
+		id : request.id,
+		type : 'result',
+		content : output.outputText,
+		diagnostics : (output.diagnostics || []).map((diagnostic) => ({
+			severity : severity(diagnostic),
+			message : ts.flattenDiagnosticMessageText(diagnostic.messageText, '\n'),
+		})),
+	};
+};
+
+const lines = readline.createInterface({ input : process.stdin });
+
+lines.on('line', (line) => {
+	if (line.trim() === '') {
+		return;
+	}
+
+	const request = JSON.parse(line);
+
+	switch (request.type) {
+		case 'ping':
+			reply({ id : request.id, type : 'pong' });
+			break;
+		case 'shutdown':
+			reply({ id : request.id, type : 'bye' });
+			process.exit(0);
+		case 'transform':
+			try {
+				reply(transpile(request));
+			} catch (err) {
+				reply({ id : request.id, type : 'result', error : String(err && err.stack || err) });
+			}
+			break;
+	}
+});
+
+lines.on('close', () => process.exit(0));
+`
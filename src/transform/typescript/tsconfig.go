@@ -0,0 +1,269 @@
+package typescript
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/nonanick/impatience/files"
+	"github.com/nonanick/impatience/watcher"
+)
+
+// TsConfig compiler options loaded from the project tsconfig, the extends
+// chain is already merged
+type TsConfig struct {
+	// Path of the loaded tsconfig
+	Path string
+	// Files every file of the extends chain, including Path
+	Files []string
+	// CompilerOptions merged compiler options, as written in the JSON
+	CompilerOptions map[string]interface{}
+}
+
+// defaultCompilerOptions used when the project has no tsconfig
+var defaultCompilerOptions = map[string]interface{}{
+	"target":                 "es2015",
+	"experimentalDecorators": true,
+}
+
+var loadedConfig = TsConfig{
+	CompilerOptions: defaultCompilerOptions,
+}
+var loadedConfigLock sync.RWMutex
+
+// watchedConfigFiles files of the extends chain already being watched
+var watchedConfigFiles = map[string]bool{}
+var watchedConfigLock sync.Mutex
+
+// UseTsConfig loads the tsconfig and watches every file of its extends
+// chain, a change reloads it and transforms all typescript files again
+func UseTsConfig(path string) {
+	reloadTsConfig(path)
+	watchTsConfig(path)
+}
+
+// CompilerOptions return the compiler options currently in use
+func CompilerOptions() map[string]interface{} {
+	loadedConfigLock.RLock()
+	defer loadedConfigLock.RUnlock()
+
+	return loadedConfig.CompilerOptions
+}
+
+func reloadTsConfig(path string) {
+	config, err := LoadTsConfig(path)
+
+	if err != nil {
+		if !os.IsNotExist(errors.Unwrap(err)) {
+			fmt.Println("Could not load tsconfig", path, err)
+		}
+		config = TsConfig{
+			Path:            path,
+			Files:           []string{path},
+			CompilerOptions: defaultCompilerOptions,
+		}
+	}
+
+	loadedConfigLock.Lock()
+	loadedConfig = config
+	loadedConfigLock.Unlock()
+}
+
+func watchTsConfig(path string) {
+	loadedConfigLock.RLock()
+	chain := loadedConfig.Files
+	loadedConfigLock.RUnlock()
+
+	unwatched := []string{}
+	watchedConfigLock.Lock()
+	for _, file := range chain {
+		if !watchedConfigFiles[file] {
+			watchedConfigFiles[file] = true
+			unwatched = append(unwatched, file)
+		}
+	}
+	watchedConfigLock.Unlock()
+
+	for _, file := range unwatched {
+		watcher.WatchFile(file, func() {
+			fmt.Println("tsconfig changed, transpiling typescript files again")
+			reloadTsConfig(path)
+			watchTsConfig(path)
+			files.Invalidate(func(file *files.File) bool {
+				return IsTranspiled(file.Path)
+			})
+		})
+	}
+}
+
+// LoadTsConfig reads a tsconfig following its "extends" chain, options of
+// the extending config override the ones it extends
+func LoadTsConfig(path string) (TsConfig, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return TsConfig{}, err
+	}
+
+	return loadTsConfig(absPath, map[string]bool{})
+}
+
+type tsConfigJSON struct {
+	Extends         json.RawMessage        `json:"extends"`
+	CompilerOptions map[string]interface{} `json:"compilerOptions"`
+}
+
+func loadTsConfig(path string, visited map[string]bool) (TsConfig, error) {
+	if visited[path] {
+		return TsConfig{}, errors.New("circular tsconfig extends chain at " + path)
+	}
+	visited[path] = true
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return TsConfig{}, fmt.Errorf("could not read %s: %w", path, err)
+	}
+
+	var parsed tsConfigJSON
+	if err := json.Unmarshal(stripJSONComments(content), &parsed); err != nil {
+		return TsConfig{}, fmt.Errorf("invalid tsconfig %s: %s", path, err.Error())
+	}
+
+	config := TsConfig{
+		Path:            path,
+		Files:           []string{},
+		CompilerOptions: map[string]interface{}{},
+	}
+
+	// "extends" may be a single config or, since TS 5, a list of them
+	extends := []string{}
+	if len(parsed.Extends) > 0 {
+		var single string
+		if json.Unmarshal(parsed.Extends, &single) == nil {
+			extends = append(extends, single)
+		} else if err := json.Unmarshal(parsed.Extends, &extends); err != nil {
+			return TsConfig{}, fmt.Errorf("invalid \"extends\" in %s", path)
+		}
+	}
+
+	for _, extended := range extends {
+		extendedPath, err := resolveExtends(extended, filepath.Dir(path))
+		if err != nil {
+			return TsConfig{}, err
+		}
+
+		base, err := loadTsConfig(extendedPath, visited)
+		if err != nil {
+			return TsConfig{}, err
+		}
+
+		config.Files = append(config.Files, base.Files...)
+		for name, value := range base.CompilerOptions {
+			config.CompilerOptions[name] = value
+		}
+	}
+
+	config.Files = append(config.Files, path)
+	for name, value := range parsed.CompilerOptions {
+		config.CompilerOptions[name] = value
+	}
+
+	return config, nil
+}
+
+// resolveExtends finds the file of an "extends" entry, either a path relative
+// to the extending config or a config published in node_modules
+func resolveExtends(extended string, fromDir string) (string, error) {
+	candidates := []string{}
+
+	if strings.HasPrefix(extended, ".") || filepath.IsAbs(extended) {
+		target := extended
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(fromDir, extended)
+		}
+		candidates = append(candidates, target, target+".json")
+	} else {
+		for dir := fromDir; ; dir = filepath.Dir(dir) {
+			target := filepath.Join(dir, "node_modules", extended)
+			candidates = append(
+				candidates,
+				target,
+				target+".json",
+				filepath.Join(target, "tsconfig.json"),
+			)
+
+			if filepath.Dir(dir) == dir {
+				break
+			}
+		}
+	}
+
+	for _, candidate := range candidates {
+		if stat, err := os.Stat(candidate); err == nil && !stat.IsDir() {
+			return candidate, nil
+		}
+	}
+
+	return "", errors.New("could not find tsconfig \"" + extended + "\" extended from " + fromDir)
+}
+
+// stripJSONComments removes comments and trailing commas, both accepted by
+// typescript in tsconfig files but not by encoding/json
+func stripJSONComments(content []byte) []byte {
+	stripped := make([]byte, 0, len(content))
+	inString := false
+
+	for i := 0; i < len(content); i++ {
+		char := content[i]
+
+		if inString {
+			stripped = append(stripped, char)
+			if char == '\\' && i+1 < len(content) {
+				i++
+				stripped = append(stripped, content[i])
+			} else if char == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case char == '"':
+			inString = true
+			stripped = append(stripped, char)
+		case char == '/' && i+1 < len(content) && content[i+1] == '/':
+			for i < len(content) && content[i] != '\n' {
+				i++
+			}
+			stripped = append(stripped, '\n')
+		case char == '/' && i+1 < len(content) && content[i+1] == '*':
+			i += 2
+			for i+1 < len(content) && !(content[i] == '*' && content[i+1] == '/') {
+				i++
+			}
+			i++
+		case char == ']' || char == '}':
+			// Drop a trailing comma before the closing bracket
+			last := len(stripped) - 1
+			for last >= 0 && isJSONSpace(stripped[last]) {
+				last--
+			}
+			if last >= 0 && stripped[last] == ',' {
+				stripped = append(stripped[:last], stripped[last+1:]...)
+			}
+			stripped = append(stripped, char)
+		default:
+			stripped = append(stripped, char)
+		}
+	}
+
+	return stripped
+}
+
+func isJSONSpace(char byte) bool {
+	return char == ' ' || char == '\t' || char == '\n' || char == '\r'
+}
@@ -1,89 +1,93 @@
 package typescript
 
 import (
+	"encoding/json"
 	"fmt"
-	"log"
-	"mime"
-	"os"
 	"os/exec"
+	"path/filepath"
 
+	"github.com/nonanick/impatience/diagnostics"
+	"github.com/nonanick/impatience/options"
 	"github.com/nonanick/impatience/transform"
+	"github.com/nonanick/impatience/transform/sourcemap"
 )
 
-// TsConverterScriptName name of the file that will be created
-var TsConverterScriptName = "impatience-ts-transpiler"
+// Name of the transformer in pipelines
+const Name = "typescript"
 
-// Register Typescript transformer
-func Register() {
-	mime.AddExtensionType(".ts", "text/javascript")
-	transform.AddFileTransformer(".ts", TranspileTs)
-}
+// Version of the transpiled output, cached outputs of other versions are
+// transpiled again
+const Version = "1"
 
-var transpilerExists = false
+// Extensions transpiled to javascript by this package
+var Extensions = []string{".ts", ".tsx", ".jsx"}
 
-//TranspileTs transpile a ts file generating an in memory js file
-var TranspileTs transform.FileTransformer = func(path string, content []byte) []byte {
+// Register Typescript/JSX transformers, the project tsconfig is loaded from
+// options.TsConfigPath
+func Register() {
+	UseTsConfig(options.TsConfigPath)
 
-	if !transpilerExists {
-		generateTsConverterScript()
-		transpilerExists = true
+	for _, extension := range Extensions {
+		transform.DeclareOutput(extension, ".js", "text/javascript")
 	}
 
-	// This works, lets try output pipe
-	cmd := exec.Command("node", TsConverterScriptName, path)
+	transform.AddTransformer(transform.Transformer{
+		Name:       Name,
+		Extensions: Extensions,
+		Priority:   transform.PriorityTranspile,
+		Transform:  TranspileTs,
+		Version:    Version,
+		Config:     cacheConfig,
+	})
+}
 
-	out, outErr := cmd.Output()
-	if outErr != nil {
-		fmt.Println("Failed to obtain output from transpiler!")
-		return content
+// cacheConfig the configuration the transpiled output depends on
+func cacheConfig() string {
+	encoded, _ := json.Marshal(map[string]interface{}{
+		"transpiler":      options.TypescriptTranspiler,
+		"compilerOptions": transpilerOptions(),
+	})
+	return string(encoded)
+}
+
+// IsTranspiled check if the file is transpiled by this package
+func IsTranspiled(path string) bool {
+	extension := filepath.Ext(path)
+	for _, typescriptExtension := range Extensions {
+		if extension == typescriptExtension {
+			return true
+		}
 	}
 
-	fmt.Println("TS transpilation finished for file: ", path)
-	return out
+	return false
 }
 
-func generateTsConverterScript() {
+// TranspileTs transpile a ts/tsx/jsx file generating an in memory js file, the
+// in-process transpiler is used unless options.TypescriptTranspiler asks
+// for node, node is also used as a fallback when available. The source map
+// of the output is returned along with it
+var TranspileTs transform.MappedFileTransformer = func(path string, content []byte) ([]byte, *sourcemap.Map) {
 
-	transpiler, err := os.Open(TsConverterScriptName)
-	if err != nil {
-		fmt.Println("Could not find transpiler")
-
-		emptyTrans, createErr := os.Create(TsConverterScriptName)
-		if createErr != nil {
-			log.Fatal("Could not create Typescript transpiler!")
-		}
+	if options.TypescriptTranspiler == "node" {
+		return sourcemap.ExtractInline(transpileWithNode(path, content))
+	}
 
-		emptyTrans.Write([]byte(transpilerScriptContent))
+	transpiled, sourceMap, messages, ok := transpileNative(path, content)
+	if ok {
+		fmt.Println("TS transpilation finished for file: ", path)
+		return transpiled, sourceMap
+	}
 
-		defer emptyTrans.Close()
+	if _, lookErr := exec.LookPath("node"); lookErr == nil {
+		for _, message := range messages {
+			diagnostics.Warnf("Typescript", path, "in-process transpiler failed, falling back to node: %s", message)
+		}
+		return sourcemap.ExtractInline(transpileWithNode(path, content))
 	}
 
-	defer transpiler.Close()
+	for _, message := range messages {
+		diagnostics.Errorf("Typescript", path, "%s", message)
+	}
 
+	return content, nil
 }
-
-var transpilerScriptContent = `
-const ts =  require('typescript');
-const fs = require('fs')
-
-const args = process.argv
-
-if (args.length > 2) {
-	
-	const compilepath = args[2];
-	const content = fs.readFileSync(compilepath).toString()
-	const transpiled = ts.transpile(content, {
-		module : ts.ModuleKind.ES2015,
-		target : ts.ScriptTarget.ES2015,
-		esModuleInterop : true,
-		noEmit : true,
-		experimentalDecorators : true,
-		moduleResolution : ts.ModuleResolutionKind.NodeJs,
-		skipLibCheck : true,
-		inlineSourceMap : true,
-		transpileOnly : true
-	})
-
-	process.stdout.write(transpiled);
-} 
-`
@@ -0,0 +1,82 @@
+// Package worker talks to long lived transformer processes, instead of
+// paying the startup of a process for each transformed file one process per
+// transformer handles every file.
+//
+// The protocol is newline delimited JSON over the process stdin/stdout, each
+// line holds exactly one message:
+//
+//	-> {"id":1,"type":"transform","path":"/abs/file.ts","content":"...","options":{}}
+//	<- {"id":1,"type":"result","content":"...","diagnostics":[{"severity":"WARN","message":"..."}]}
+//	<- {"id":1,"type":"result","error":"could not transform file"}
+//
+//	-> {"id":2,"type":"ping"}
+//	<- {"id":2,"type":"pong"}
+//
+//	-> {"id":3,"type":"cancel","cancel":1}
+//
+//	-> {"id":4,"type":"shutdown"}
+//	<- {"id":4,"type":"bye"}
+//
+// Responses may arrive in any order, the id links them to their request.
+// Anything the process writes to stderr is logged by Impatience
+package worker
+
+import (
+	"encoding/json"
+
+	"github.com/nonanick/impatience/diagnostics"
+)
+
+// Message types used by the protocol
+const (
+	TypeTransform = "transform"
+	TypeResult    = "result"
+	TypePing      = "ping"
+	TypePong      = "pong"
+	TypeCancel    = "cancel"
+	TypeShutdown  = "shutdown"
+	TypeBye       = "bye"
+)
+
+// Request message sent to the worker process
+type Request struct {
+	ID      uint64          `json:"id"`
+	Type    string          `json:"type"`
+	Path    string          `json:"path,omitempty"`
+	Content string          `json:"content,omitempty"`
+	Options json.RawMessage `json:"options,omitempty"`
+	Cancel  uint64          `json:"cancel,omitempty"`
+}
+
+// Response message sent back by the worker process
+type Response struct {
+	ID          uint64       `json:"id"`
+	Type        string       `json:"type"`
+	Content     string       `json:"content,omitempty"`
+	Diagnostics []Diagnostic `json:"diagnostics,omitempty"`
+	Error       string       `json:"error,omitempty"`
+}
+
+// Diagnostic problem reported by the worker while transforming a file, the
+// severity is either "ERROR" or "WARN"
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// Report forwards the diagnostics sent by the worker to Impatience
+func (r Response) Report(source string, path string) {
+	for _, diagnostic := range r.Diagnostics {
+		severity := diagnostics.Error
+		if diagnostic.Severity == string(diagnostics.Warning) {
+			severity = diagnostics.Warning
+		}
+
+		diagnostics.Report(diagnostics.Diagnostic{
+			Source:   source,
+			Path:     path,
+			Severity: severity,
+			Message:  diagnostic.Message,
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package worker
+
+import (
+	"strings"
+	"sync"
+)
+
+var workers = map[string]*Worker{}
+var workersLock sync.Mutex
+
+// Get return the worker registered with the name, creating it with the
+// command when it does not exist yet
+func Get(name string, command string) *Worker {
+	return GetArgs(name, strings.Fields(command))
+}
+
+// GetArgs same as Get but the command arguments are given already split,
+// useful when an argument contains spaces
+func GetArgs(name string, args []string) *Worker {
+	workersLock.Lock()
+	defer workersLock.Unlock()
+
+	if existing, exists := workers[name]; exists {
+		return existing
+	}
+
+	created := &Worker{
+		Name:    name,
+		Command: args,
+	}
+	workers[name] = created
+
+	return created
+}
+
+// Register adds an already configured worker, replacing any worker with the
+// same name
+func Register(w *Worker) {
+	workersLock.Lock()
+	previous := workers[w.Name]
+	workers[w.Name] = w
+	workersLock.Unlock()
+
+	if previous != nil && previous != w {
+		previous.Shutdown()
+	}
+}
+
+// ShutdownAll gracefully stops every registered worker
+func ShutdownAll() {
+	workersLock.Lock()
+	all := []*Worker{}
+	for _, w := range workers {
+		all = append(all, w)
+	}
+	workersLock.Unlock()
+
+	var wait sync.WaitGroup
+	for _, w := range all {
+		wait.Add(1)
+		go func(w *Worker) {
+			defer wait.Done()
+			w.Shutdown()
+		}(w)
+	}
+	wait.Wait()
+}
@@ -0,0 +1,391 @@
+package worker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheckInterval how often a running worker is pinged
+var HealthCheckInterval = 30 * time.Second
+
+// HealthCheckTimeout how long a worker has to answer a ping before being
+// considered stuck and restarted
+var HealthCheckTimeout = 5 * time.Second
+
+// ShutdownTimeout how long a worker has to exit after being asked to
+var ShutdownTimeout = 5 * time.Second
+
+// MaxRestarts max number of times a worker may be restarted in a minute,
+// a worker that keeps crashing is not restarted again
+var MaxRestarts = 5
+
+// ErrWorkerExited the worker process exited before answering
+var ErrWorkerExited = errors.New("worker process exited")
+
+// ErrWorkerClosed the worker was shut down
+var ErrWorkerClosed = errors.New("worker was shut down")
+
+// Worker a long lived transformer process, the process is started on the
+// first request and restarted after a crash
+type Worker struct {
+	Name    string
+	Command []string
+	Env     []string
+
+	lock     sync.Mutex
+	current  *process
+	nextID   uint64
+	restarts []time.Time
+	closed   bool
+}
+
+// process a running instance of the worker command
+type process struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	writeLock sync.Mutex
+
+	pendingLock sync.Mutex
+	pending     map[uint64]chan Response
+
+	exited chan struct{}
+}
+
+// New creates a worker for the command, the process is not started until
+// the worker is needed
+func New(name string, command string) *Worker {
+	return &Worker{
+		Name:    name,
+		Command: strings.Fields(command),
+	}
+}
+
+// Transform asks the worker to transform a file, options are passed as is
+// to the worker process
+func (w *Worker) Transform(
+	ctx context.Context,
+	path string,
+	content []byte,
+	options interface{},
+) (Response, error) {
+
+	request := Request{
+		Type:    TypeTransform,
+		Path:    path,
+		Content: string(content),
+	}
+
+	if options != nil {
+		encoded, err := json.Marshal(options)
+		if err != nil {
+			return Response{}, errors.New("could not encode transform options: " + err.Error())
+		}
+		request.Options = encoded
+	}
+
+	response, err := w.send(ctx, request)
+	if err != nil {
+		return response, err
+	}
+
+	if response.Error != "" {
+		return response, errors.New(response.Error)
+	}
+
+	return response, nil
+}
+
+// Ping checks if the worker is answering
+func (w *Worker) Ping(timeout time.Duration) error {
+	current, err := w.running()
+	if err != nil {
+		return err
+	}
+
+	return w.ping(current, timeout)
+}
+
+// ping checks if the process is answering
+func (w *Worker) ping(target *process, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	response, err := w.sendTo(ctx, target, Request{Type: TypePing})
+	if err != nil {
+		return err
+	}
+
+	if response.Type != TypePong {
+		return errors.New("worker answered ping with " + response.Type)
+	}
+
+	return nil
+}
+
+// Shutdown asks the worker process to exit, it is killed if it does not
+// exit in time. A worker that was shut down does not accept new requests
+func (w *Worker) Shutdown() {
+	w.lock.Lock()
+	w.closed = true
+	current := w.current
+	w.current = nil
+	w.lock.Unlock()
+
+	if current != nil {
+		current.stop(w.nextRequestID(), ShutdownTimeout)
+	}
+}
+
+// send writes the request and waits for the response with the same id
+func (w *Worker) send(ctx context.Context, request Request) (Response, error) {
+	current, err := w.running()
+	if err != nil {
+		return Response{}, err
+	}
+
+	return w.sendTo(ctx, current, request)
+}
+
+// sendTo writes the request to a given process and waits for its response
+func (w *Worker) sendTo(ctx context.Context, current *process, request Request) (Response, error) {
+	request.ID = w.nextRequestID()
+	answer := current.expect(request.ID)
+	defer current.forget(request.ID)
+
+	if err := current.write(request); err != nil {
+		current.kill()
+		return Response{}, errors.New("could not write to worker: " + err.Error())
+	}
+
+	select {
+	case response := <-answer:
+		return response, nil
+	case <-current.exited:
+		return Response{}, ErrWorkerExited
+	case <-ctx.Done():
+		if request.Type == TypeTransform {
+			current.write(Request{
+				ID:     w.nextRequestID(),
+				Type:   TypeCancel,
+				Cancel: request.ID,
+			})
+		}
+		return Response{}, ctx.Err()
+	}
+}
+
+func (w *Worker) nextRequestID() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.nextID++
+	return w.nextID
+}
+
+// running return the current process starting a new one when necessary
+func (w *Worker) running() (*process, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.closed {
+		return nil, ErrWorkerClosed
+	}
+
+	if w.current != nil {
+		select {
+		case <-w.current.exited:
+			fmt.Println("[Worker", w.Name+"] process exited, restarting it")
+		default:
+			return w.current, nil
+		}
+	}
+
+	// Forget restarts older than a minute
+	recent := []time.Time{}
+	for _, restart := range w.restarts {
+		if time.Since(restart) < time.Minute {
+			recent = append(recent, restart)
+		}
+	}
+	w.restarts = recent
+
+	if len(w.restarts) >= MaxRestarts {
+		return nil, fmt.Errorf("worker %s crashed %d times in the last minute, giving up", w.Name, len(w.restarts))
+	}
+
+	if w.current != nil {
+		w.restarts = append(w.restarts, time.Now())
+	}
+
+	started, err := w.start()
+	if err != nil {
+		return nil, err
+	}
+
+	w.current = started
+	go w.checkHealth(started)
+
+	return started, nil
+}
+
+func (w *Worker) start() (*process, error) {
+	if len(w.Command) == 0 {
+		return nil, errors.New("worker " + w.Name + " has no command")
+	}
+
+	cmd := exec.Command(w.Command[0], w.Command[1:]...)
+	if len(w.Env) > 0 {
+		cmd.Env = w.Env
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, errors.New("could not start worker " + w.Name + ": " + err.Error())
+	}
+
+	started := &process{
+		cmd:     cmd,
+		stdin:   stdin,
+		pending: map[uint64]chan Response{},
+		exited:  make(chan struct{}),
+	}
+
+	go started.read(w.Name, stdout)
+	go logOutput(w.Name, stderr)
+
+	return started, nil
+}
+
+// checkHealth pings the process until it exits, a process that stops
+// answering is killed so the next request restarts it
+func (w *Worker) checkHealth(watched *process) {
+	ticker := time.NewTicker(HealthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-watched.exited:
+			return
+		case <-ticker.C:
+			// Pinging the watched process itself, a restarted worker must
+			// not answer for the one that stopped
+			if err := w.ping(watched, HealthCheckTimeout); err != nil {
+				fmt.Println("[Worker", w.Name+"] failed health check, killing it:", err)
+				watched.kill()
+				return
+			}
+		}
+	}
+}
+
+// read dispatches each response line to the request waiting for it
+func (p *process) read(name string, stdout io.Reader) {
+	defer close(p.exited)
+	defer p.cmd.Wait()
+
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var response Response
+			if decodeErr := json.Unmarshal(line, &response); decodeErr != nil {
+				fmt.Println("[Worker", name+"] sent an invalid message:", decodeErr)
+			} else {
+				p.deliver(response)
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (p *process) expect(id uint64) chan Response {
+	answer := make(chan Response, 1)
+
+	p.pendingLock.Lock()
+	p.pending[id] = answer
+	p.pendingLock.Unlock()
+
+	return answer
+}
+
+func (p *process) forget(id uint64) {
+	p.pendingLock.Lock()
+	delete(p.pending, id)
+	p.pendingLock.Unlock()
+}
+
+func (p *process) deliver(response Response) {
+	p.pendingLock.Lock()
+	answer, waiting := p.pending[response.ID]
+	delete(p.pending, response.ID)
+	p.pendingLock.Unlock()
+
+	if waiting {
+		answer <- response
+	}
+}
+
+func (p *process) write(request Request) error {
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	p.writeLock.Lock()
+	defer p.writeLock.Unlock()
+
+	_, err = p.stdin.Write(append(encoded, '\n'))
+	return err
+}
+
+// stop asks the process to exit and kills it after the timeout
+func (p *process) stop(id uint64, timeout time.Duration) {
+	p.write(Request{ID: id, Type: TypeShutdown})
+	p.stdin.Close()
+
+	select {
+	case <-p.exited:
+	case <-time.After(timeout):
+		p.kill()
+	}
+}
+
+func (p *process) kill() {
+	if p.cmd.Process != nil {
+		p.cmd.Process.Kill()
+	}
+}
+
+func logOutput(name string, output io.Reader) {
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		fmt.Println("[Worker", name+"]", scanner.Text())
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/kr/pretty"
 	"github.com/nonanick/impatience/files"
@@ -20,6 +22,38 @@ var TrackedDirectories = map[string]bool{}
 // all subdirectories will also be ignored!
 var IgnoreDirectories = []string{}
 
+// watchedFiles callbacks of single files being watched, usually
+// configuration files living outside the public root
+var watchedFiles = map[string][]func(){}
+
+// watchedFileDirectories directories added to the watcher only because of
+// a watched file
+var watchedFileDirectories = map[string]bool{}
+
+var watchedFilesLock sync.Mutex
+
+// fsWatcher the running watcher, nil until Watch is called
+var fsWatcher *fsnotify.Watcher
+
+// WatchFile calls onChange each time the file is written, created or
+// removed, the file does not need to be inside the public root
+func WatchFile(file string, onChange func()) {
+	absPath, err := filepath.Abs(file)
+	if err != nil {
+		pretty.Println("Failed to watch file!", file, err)
+		return
+	}
+
+	watchedFilesLock.Lock()
+	watchedFiles[absPath] = append(watchedFiles[absPath], onChange)
+	running := fsWatcher
+	watchedFilesLock.Unlock()
+
+	if running != nil {
+		addFileDirectory(running, absPath)
+	}
+}
+
 // Watch watch for directory changes
 func Watch() {
 	watcher, err := fsnotify.NewWatcher()
@@ -32,24 +66,31 @@ func Watch() {
 
 	go handleFSWatchEvents(watcher)
 
+	watchedFilesLock.Lock()
+	fsWatcher = watcher
+	watched := []string{}
+	for file := range watchedFiles {
+		watched = append(watched, file)
+	}
+	watchedFilesLock.Unlock()
+
+	for _, file := range watched {
+		addFileDirectory(watcher, file)
+	}
+
 	for _, file := range files.All() {
 
 		if TrackedDirectories[file.Dir] != true &&
-			!strings.HasSuffix(
-				file.Dir,
-				strings.ReplaceAll(
-					nodemodules.NodePublicRoot,
-					"/",
-					string(os.PathSeparator),
-				),
-			) &&
+			!strings.HasPrefix(file.PublicPath, nodemodules.NodePublicRoot) &&
 			file.Path != "" {
 			err := watcher.Add(file.Dir)
 			if err != nil {
 				pretty.Println("Failed to add directory to watcher!", file.Dir)
 			} else {
 				pretty.Println("Added directory to watcher!", file.Dir)
+				watchedFilesLock.Lock()
 				TrackedDirectories[file.Dir] = true
+				watchedFilesLock.Unlock()
 			}
 
 		}
@@ -67,6 +108,11 @@ func handleFSWatchEvents(watcher *fsnotify.Watcher) {
 				return
 			}
 
+			// Watched file --> notify, it is not a public file
+			if notifyWatchedFile(event) || isWatchedFileDirectory(event.Name) {
+				continue
+			}
+
 			// Write event --> Update LastModified
 			if event.Op&fsnotify.Write == fsnotify.Write {
 				pretty.Println("FS Watch, triggered write event!", event)
@@ -93,6 +139,57 @@ func handleFSWatchEvents(watcher *fsnotify.Watcher) {
 	}
 }
 
+// addFileDirectory watches the directory of a watched file, fsnotify loses
+// track of files replaced by editors when watching the file itself
+func addFileDirectory(watcher *fsnotify.Watcher, file string) {
+	directory := filepath.Dir(file)
+
+	watchedFilesLock.Lock()
+	defer watchedFilesLock.Unlock()
+
+	if watchedFileDirectories[directory] ||
+		TrackedDirectories[directory+string(os.PathSeparator)] {
+		return
+	}
+
+	if err := watcher.Add(directory); err != nil {
+		pretty.Println("Failed to add directory to watcher!", directory)
+		return
+	}
+
+	watchedFileDirectories[directory] = true
+}
+
+// notifyWatchedFile runs the callbacks of the file changed by the event,
+// return false when the file is not being watched
+func notifyWatchedFile(event fsnotify.Event) bool {
+	if event.Op&fsnotify.Chmod == event.Op {
+		return false
+	}
+
+	watchedFilesLock.Lock()
+	callbacks := watchedFiles[filepath.Clean(event.Name)]
+	watchedFilesLock.Unlock()
+
+	for _, onChange := range callbacks {
+		onChange()
+	}
+
+	return len(callbacks) > 0
+}
+
+// isWatchedFileDirectory when the file is inside a directory that is only
+// watched because of a watched file, its events must be ignored
+func isWatchedFileDirectory(file string) bool {
+	directory := filepath.Dir(file)
+
+	watchedFilesLock.Lock()
+	defer watchedFilesLock.Unlock()
+
+	return watchedFileDirectories[directory] &&
+		!TrackedDirectories[directory+string(os.PathSeparator)]
+}
+
 func updateRemovedFile(file string) {
 	files.Remove(file)
 }